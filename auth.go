@@ -0,0 +1,303 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/dullgiulio/umarell/store"
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// Iterations used when hashing new secrets
+const pbkdf2Iterations = 100000
+
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleDeploy
+	roleAdmin
+)
+
+var roleNames = map[string]role{
+	"read":   roleRead,
+	"deploy": roleDeploy,
+	"admin":  roleAdmin,
+}
+
+// tokenConfig is an API token, given as "Authorization: Bearer TOKEN" or as "token" parameter.
+type tokenConfig struct {
+	Name string `json:"name"` // reported as the user of the token
+	Hash string `json:"hash"`
+	Role string `json:"role"`
+}
+
+type userConfig struct {
+	Password string `json:"password"` // hash of the password
+	Role     string `json:"role"`
+}
+
+type authConfig struct {
+	// Role of requests without credentials, none if empty
+	AnonymousRole string `json:"anonymous_role"`
+	// Users that can log in with HTTP basic auth
+	Users map[string]userConfig `json:"users"`
+	// Tokens valid for all projects
+	Tokens []tokenConfig `json:"tokens"`
+}
+
+// HashSecret returns the hash of a password to put in the configuration.
+func HashSecret(secret string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, salt, pbkdf2Iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256:%d:%x:%x", pbkdf2Iterations, salt, key), nil
+}
+
+// NewToken returns a random API token and its hash to put in the configuration.
+// Tokens are random, a plain SHA256 makes checking them cheap.
+func NewToken() (string, string, error) {
+	data := make([]byte, 24)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(data)
+	return token, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(token))), nil
+}
+
+var errHashFormat = errors.New("hash must be sha256:HEX or pbkdf2-sha256:ITERATIONS:SALT:KEY")
+
+type secretHash struct {
+	iter int // zero for plain SHA256
+	salt []byte
+	key  []byte
+}
+
+// parseHash parses a hash in the sha256:HEX or pbkdf2-sha256:ITERATIONS:SALT:KEY format.
+func parseHash(hash string) (*secretHash, error) {
+	var (
+		h   secretHash
+		err error
+	)
+	parts := strings.Split(hash, ":")
+	switch {
+	case len(parts) == 2 && parts[0] == "sha256":
+		if h.key, err = hex.DecodeString(parts[1]); err != nil || len(h.key) != sha256.Size {
+			return nil, errHashFormat
+		}
+	case len(parts) == 4 && parts[0] == "pbkdf2-sha256":
+		if h.iter, err = strconv.Atoi(parts[1]); err != nil || h.iter <= 0 {
+			return nil, errHashFormat
+		}
+		if h.salt, err = hex.DecodeString(parts[2]); err != nil {
+			return nil, errHashFormat
+		}
+		if h.key, err = hex.DecodeString(parts[3]); err != nil || len(h.key) == 0 {
+			return nil, errHashFormat
+		}
+	default:
+		return nil, errHashFormat
+	}
+	return &h, nil
+}
+
+func (h *secretHash) verify(secret string) bool {
+	if h.iter == 0 {
+		sum := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare(sum[:], h.key) == 1
+	}
+	key, err := pbkdf2.Key(sha256.New, secret, h.salt, h.iter, len(h.key))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// verifySecret returns true if secret matches hash.
+func verifySecret(hash, secret string) bool {
+	h, err := parseHash(hash)
+	if err != nil {
+		return false
+	}
+	return h.verify(secret)
+}
+
+func checkRole(errs *configErrors, path, name string, empty bool) {
+	if name == "" && empty {
+		return
+	}
+	if _, ok := roleNames[name]; !ok {
+		errs.add(path, "unknown role %q, use read, deploy or admin", name)
+	}
+}
+
+func checkTokens(errs *configErrors, path string, tokens []tokenConfig) {
+	for i, t := range tokens {
+		tpath := fmt.Sprintf("%s[%d]", path, i)
+		if _, err := parseHash(t.Hash); err != nil {
+			errs.add(tpath+".hash", "%s", err)
+		}
+		checkRole(errs, tpath+".role", t.Role, false)
+	}
+}
+
+func (a *authConfig) check(errs *configErrors, path string) {
+	checkRole(errs, path+".anonymous_role", a.AnonymousRole, true)
+	for name, u := range a.Users {
+		upath := path + ".users." + name
+		if _, err := parseHash(u.Password); err != nil {
+			errs.add(upath+".password", "%s", err)
+		}
+		checkRole(errs, upath+".role", u.Role, false)
+	}
+	checkTokens(errs, path+".tokens", a.Tokens)
+}
+
+// authEnabled returns true if any credentials are configured.
+func (c *config) authEnabled() bool {
+	if c.Auth != nil {
+		return true
+	}
+	for _, env := range c.Envs {
+		if len(env.Tokens) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestToken returns the API token of a request, if any.
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("token")
+}
+
+// matchToken returns the first token matching secret.
+func matchToken(tokens []tokenConfig, secret string) (*tokenConfig, bool) {
+	for i := range tokens {
+		if verifySecret(tokens[i].Hash, secret) {
+			return &tokens[i], true
+		}
+	}
+	return nil, false
+}
+
+// authenticate returns the role and the name of the user of a request.
+// Invalid credentials return false.
+func (c *config) authenticate(r *http.Request, project string) (role, string, bool) {
+	var (
+		granted role
+		user    string
+	)
+	if c.Auth != nil {
+		granted = roleNames[c.Auth.AnonymousRole]
+	}
+	if name, password, ok := r.BasicAuth(); ok {
+		var u userConfig
+		if c.Auth != nil {
+			u, ok = c.Auth.Users[name]
+		}
+		if !ok {
+			return roleNone, "", false
+		}
+		if !verifySecret(u.Password, password) {
+			return roleNone, "", false
+		}
+		if roleNames[u.Role] > granted {
+			granted = roleNames[u.Role]
+		}
+		user = name
+	}
+	if secret := requestToken(r); secret != "" {
+		var tokens []tokenConfig
+		if c.Auth != nil {
+			tokens = c.Auth.Tokens
+		}
+		t, ok := matchToken(tokens, secret)
+		// Project tokens only grant access to their project
+		if !ok && project != "" {
+			t, ok = matchToken(c.Envs[project].Tokens, secret)
+		}
+		if !ok {
+			return roleNone, "", false
+		}
+		if roleNames[t.Role] > granted {
+			granted = roleNames[t.Role]
+		}
+		user = t.Name
+		if user == "" {
+			user = "token"
+		}
+	}
+	return granted, user, true
+}
+
+type authKey int
+
+const userKey authKey = 0
+
+// requestUser returns the authenticated user of a request.
+func requestUser(r *http.Request) string {
+	if user, ok := gcontext.Get(r, userKey).(string); ok {
+		return user
+	}
+	return "anonymous"
+}
+
+// requestTrigger returns the API trigger for requests with a token, def otherwise.
+func requestTrigger(r *http.Request, def store.BuildTrigger) store.BuildTrigger {
+	if requestToken(r) != "" {
+		return store.BuildTriggerAPI
+	}
+	return def
+}
+
+// authorize wraps a handler to only serve requests with at least the needed role.
+func (s *server) authorize(need role, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := s.config()
+		if !c.authEnabled() {
+			h(w, r)
+			return
+		}
+		granted, user, ok := c.authenticate(r, mux.Vars(r)["project"])
+		if ok && granted >= need {
+			if user != "" {
+				gcontext.Set(r, userKey, user)
+			}
+			h(w, r)
+			return
+		}
+		if !ok || user == "" {
+			if c.Auth != nil && len(c.Auth.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="umarell"`)
+			}
+			s.log.Printf("[http] %s: unauthenticated request to %s", r.RemoteAddr, r.URL.Path)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		s.log.Printf("[http] %s: user %s is not allowed to access %s", r.RemoteAddr, user, r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	}
+}
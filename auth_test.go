@@ -0,0 +1,124 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestHashSecret(t *testing.T) {
+	hash, err := HashSecret("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifySecret(hash, "s3cr3t") || verifySecret(hash, "secret") {
+		t.Error("password hash not verified correctly")
+	}
+	token, hash, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verifySecret(hash, token) || verifySecret(hash, token+"x") {
+		t.Error("token hash not verified correctly")
+	}
+	if _, err := parseHash("md5:abc"); err == nil {
+		t.Error("expected error for unknown hash")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	password, _ := HashSecret("s3cr3t")
+	nemoToken, nemoHash, _ := NewToken()
+	s := &server{
+		conf: &config{
+			Auth: &authConfig{
+				AnonymousRole: "read",
+				Users:         map[string]userConfig{"giulio": {Password: password, Role: "admin"}},
+			},
+			Envs: map[string]envConfig{
+				"projectNemo": {Tokens: []tokenConfig{{Name: "ci", Hash: nemoHash, Role: "deploy"}}},
+				"projectDory": {},
+			},
+		},
+		log: discardLogger,
+	}
+	var user string
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		user = requestUser(r)
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/_/json", s.authorize(roleRead, ok))
+	r.HandleFunc("/{project}/delete", s.authorize(roleAdmin, ok))
+	r.HandleFunc("/{project}/jenkins/git/notifyCommit", s.authorize(roleDeploy, ok))
+
+	tests := []struct {
+		path     string
+		user     string
+		password string
+		status   int
+	}{
+		{"/_/json", "", "", http.StatusOK},
+		{"/projectNemo/jenkins/git/notifyCommit", "", "", http.StatusUnauthorized},
+		{"/projectNemo/jenkins/git/notifyCommit?token=" + nemoToken, "", "", http.StatusOK},
+		{"/projectDory/jenkins/git/notifyCommit?token=" + nemoToken, "", "", http.StatusUnauthorized},
+		{"/projectNemo/delete?token=" + nemoToken, "", "", http.StatusForbidden},
+		{"/projectNemo/delete", "giulio", "wrong", http.StatusUnauthorized},
+		{"/projectNemo/delete", "giulio", "s3cr3t", http.StatusOK},
+	}
+	for _, tt := range tests {
+		user = ""
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s as %q: expected status %d, got %d", tt.path, tt.user, tt.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected basic auth challenge", tt.path)
+		}
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/projectNemo/jenkins/git/notifyCommit?token="+nemoToken, nil))
+	if user != "ci" {
+		t.Errorf("expected token user ci, got %s", user)
+	}
+}
+
+func TestAuthorizeOtherProjectStage(t *testing.T) {
+	nemoToken, nemoHash, _ := NewToken()
+	s := newBuildsServer()
+	s.conf.Auth = &authConfig{}
+	nemo := s.conf.Envs["projectNemo"]
+	nemo.Tokens = []tokenConfig{{Name: "ci", Hash: nemoHash, Role: "read"}}
+	s.conf.Envs["projectNemo"] = nemo
+	r := buildsRouter(s, func(h http.HandlerFunc) http.HandlerFunc {
+		return s.authorize(roleRead, h)
+	})
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/projectNemo/stages/projectNemo.ticket12/builds", http.StatusOK},
+		{"/projectDory/stages/projectDory.ticket1/builds", http.StatusUnauthorized},
+		// The token of projectNemo does not give access to the stages of projectDory
+		{"/projectNemo/stages/projectDory.ticket1/builds", http.StatusNotFound},
+		{"/projectNemo/stages/projectDory.ticket1/builds/5/stdout", http.StatusNotFound},
+		{"/projectNemo/stages/projectDory.ticket1/live", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tt.path+"?token="+nemoToken, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package umarell
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
@@ -62,7 +63,7 @@ func newCommand(act store.BuildAct, b *build) *command {
 	if len(cmd) == 0 {
 		return nil
 	}
-	cmd = b.stageVars.apply(cmd)
+	cmd = b.cmdVars(b.branch).apply(cmd)
 	return &command{
 		cmd:  exec.Command(cmd[0], cmd[1:]...),
 		name: strings.Join(cmd, " "),
@@ -92,7 +93,7 @@ func (br branchStages) match(branch string, log logger) ([]string, bool) {
 		}
 		found, err = regexp.MatchString(pattern, branch)
 		if err != nil {
-			log.Printf("[build] cannot match %s against %s: %s", branch, pattern, err)
+			log.Errorf("[build] cannot match %s against %s: %s", branch, pattern, err)
 			continue
 		}
 		if found {
@@ -103,16 +104,34 @@ func (br branchStages) match(branch string, log logger) ([]string, bool) {
 }
 
 type buildReq struct {
-	act    store.BuildAct
-	notif  *notif
-	doneCh chan struct{}
+	act   store.BuildAct
+	notif *notif
+	token int64
+	// When the request or its notification was queued
+	queued time.Time
+	// Cancelled when a newer request makes this one obsolete
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Set when the command has run
+	result *store.BuildResult
+	// Called from the build goroutine when the request is done, can be nil
+	after func(*store.BuildResult)
 }
 
-func newBuildReq(act store.BuildAct, n *notif) *buildReq {
+func newBuildReq(act store.BuildAct, n *notif, token int64, after func(*store.BuildResult)) *buildReq {
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := n.queued
+	if queued.IsZero() {
+		queued = time.Now()
+	}
 	return &buildReq{
 		act:    act,
 		notif:  n,
-		doneCh: make(chan struct{}),
+		token:  token,
+		queued: queued,
+		ctx:    ctx,
+		cancel: cancel,
+		after:  after,
 	}
 }
 
@@ -121,15 +140,14 @@ func (r *buildReq) String() string {
 }
 
 func (r *buildReq) done() {
-	close(r.doneCh)
-}
-
-func (r *buildReq) wait() {
-	<-r.doneCh
+	r.cancel()
+	if r.after != nil {
+		r.after(r.result)
+	}
 }
 
 func parseTicketNo(srv *server, branch string) (int64, error) {
-	groups := srv.regexBranch.FindAllStringSubmatch(branch, -1)
+	groups := srv.config().regexBranch.FindAllStringSubmatch(branch, -1)
 	if len(groups) > 0 && len(groups[0]) > 1 {
 		return strconv.ParseInt(groups[0][1], 10, 64)
 	}
@@ -137,18 +155,23 @@ func parseTicketNo(srv *server, branch string) (int64, error) {
 }
 
 type build struct {
-	project   string
-	stage     string
-	branch    string
-	sha1      string
-	ticketNo  int64
+	project  string
+	stage    string
+	branch   string
+	sha1     string
+	ticketNo int64
+	// The create command was cancelled, the next deployment must create the stage
+	uncreated bool
 	reqs      chan *buildReq
-	stageVars vars
 	srv       *server
+	// Closed when all requests are done after destroy
+	finished chan struct{}
+	// Finished channel of the build previously using the same stage
+	prev <-chan struct{}
 }
 
 func newBuilds(n *notif, srv *server) ([]*build, error) {
-	procf, ok := srv.conf.Envs[n.project]
+	procf, ok := srv.config().Envs[n.project]
 	if !ok {
 		return nil, fmt.Errorf("project %s not configured", n.project)
 	}
@@ -179,9 +202,10 @@ func newBuilds(n *notif, srv *server) ([]*build, error) {
 			sha1:     n.sha1,
 			srv:      srv,
 			ticketNo: ticketNo,
-			reqs:     make(chan *buildReq), // XXX: can be buffered
+			reqs:     make(chan *buildReq),
+			finished: make(chan struct{}),
 		}
-		b.initVars(n.project, tmpl)
+		b.initStage(tmpl)
 		bs = append(bs, b)
 	}
 	return bs, nil
@@ -191,27 +215,39 @@ func (b *build) String() string {
 	return fmt.Sprintf("%s: %s", b.stage, b.branch)
 }
 
+// logger returns the server logger with the fields of this build that
+// do not change, so it can be used outside of the worker.
+func (b *build) logger() logger {
+	return b.srv.log.with("project", b.project, "stage", b.stage)
+}
+
+// reqLogger returns the build logger with the fields of the request.
+func (b *build) reqLogger(req *buildReq) logger {
+	return b.logger().with("branch", req.notif.branch, "sha1", req.notif.sha1, "act", req.act.String(), "token", req.token)
+}
+
 func (b *build) getCmd(c string) []string {
 	var cmd []string
-	bcmd := b.srv.conf.Envs[b.project].Commands
+	conf := b.srv.config()
+	bcmd := conf.Envs[b.project].Commands
 	switch c {
 	case "create":
-		cmd = b.srv.conf.Commands.CmdCreate
+		cmd = conf.Commands.CmdCreate
 		if bcmd != nil && bcmd.CmdCreate != nil {
 			cmd = bcmd.CmdCreate
 		}
 	case "change":
-		cmd = b.srv.conf.Commands.CmdChange
+		cmd = conf.Commands.CmdChange
 		if bcmd != nil && bcmd.CmdChange != nil {
 			cmd = bcmd.CmdChange
 		}
 	case "update":
-		cmd = b.srv.conf.Commands.CmdUpdate
+		cmd = conf.Commands.CmdUpdate
 		if bcmd != nil && bcmd.CmdUpdate != nil {
 			cmd = bcmd.CmdUpdate
 		}
 	case "destroy":
-		cmd = b.srv.conf.Commands.CmdDestroy
+		cmd = conf.Commands.CmdDestroy
 		if bcmd != nil && bcmd.CmdDestroy != nil {
 			cmd = bcmd.CmdDestroy
 		}
@@ -221,14 +257,14 @@ func (b *build) getCmd(c string) []string {
 	return cmd
 }
 
-func (b *build) url(tmpl string) string {
+func (b *build) url(tmpl, branch string) string {
 	// Variables to make the GET url, Jenkins-style
 	v := url.Values{}
-	v.Set("branches", b.branch)
+	v.Set("branches", branch)
 	v.Set("sha1", b.sha1)
 	// Variables to display in the template
 	vs := makeVars()
-	vs.add("branch", b.branch)
+	vs.add("branch", branch)
 	vs.add("sha1", b.sha1)
 	vs.add("ticket", fmt.Sprintf("%d", b.ticketNo))
 	vs.add("project", b.project)
@@ -236,52 +272,93 @@ func (b *build) url(tmpl string) string {
 	return vs.applySingle(tmpl)
 }
 
-func (b *build) initVars(project, tmpl string) {
+// links returns the URL of the deployed environment and the redeploy link
+// when the stage tracks branch.
+func (b *build) links(branch string) stageURLs {
+	return stageURLs{
+		URL:      b.cmdVars(branch).applySingle(b.srv.config().Envs[b.project].URL),
+		Redeploy: b.url(reverseJenkinsURL, branch),
+	}
+}
+
+// cmdVars returns the placeholders of the commands when the stage tracks branch.
+// The branch is passed in as only the worker can read the current one.
+func (b *build) cmdVars(branch string) vars {
+	vs := b.stageVars(branch)
+	vs.add("STAGE", b.stage)
+	return vs
+}
+
+func (b *build) stageVars(branch string) vars {
 	vs := makeVars()
-	vs.add("ENV", project)
+	vs.add("ENV", b.project)
 	vs.add("TICKET", fmt.Sprintf("%d", b.ticketNo))
-	vs.add("BRANCH", b.branch)
-	// Stage can include the previous vars
-	b.stage = vs.applySingle(tmpl)
-	vs.add("STAGE", b.stage)
-	b.stageVars = vs
+	vs.add("BRANCH", branch)
+	return vs
+}
+
+func (b *build) initStage(tmpl string) {
+	// Stage can include the other vars
+	b.stage = b.stageVars(b.branch).applySingle(tmpl)
 }
 
-func (b *build) execResult(c *command) (*store.BuildResult, error) {
-	return execResult(c.cmd, time.Duration(b.srv.conf.CommandTimeout))
+func (b *build) execResult(ctx context.Context, c *command) (*store.BuildResult, error) {
+	live := newLiveLog(liveBufferSize)
+	b.srv.lives.set(b.stage, live)
+	defer live.close()
+	conf := b.srv.config()
+	return execResult(ctx, c.cmd, time.Duration(conf.CommandTimeout), conf.killPolicy(), live)
+}
+
+// setBranch switches the branch used in the commands.
+func (b *build) setBranch(branch string) {
+	b.branch = branch
 }
 
 func (b *build) prepare(req *buildReq) {
+	if b.uncreated && req.act != store.BuildActDestroy {
+		req.act = store.BuildActCreate
+		b.setBranch(req.notif.branch)
+		return
+	}
 	// On a change request, we might have a different branch
 	if req.act == store.BuildActChange {
 		if b.branch == req.notif.branch {
 			req.act = store.BuildActUpdate
 		} else {
-			b.branch = req.notif.branch
-			b.stageVars.add("BRANCH", b.branch)
+			b.setBranch(req.notif.branch)
 		}
 	}
 }
 
 func (b *build) execute(cmd *command, req *buildReq) (*store.BuildResult, error) {
 	// Run the actual build command
-	b.srv.log.Printf("[build] %s: start '%s'", b, cmd)
-	br, err := b.execResult(cmd)
-	b.srv.log.Printf("[build] %s: done '%s'", b, cmd)
-	if err != nil {
-		return br, fmt.Errorf("command execution failed: %s", err)
-	}
-	return br, nil
+	log := b.reqLogger(req)
+	log.Printf("[build] start '%s'", cmd)
+	br, err := b.execResult(req.ctx, cmd)
+	log.Printf("[build] done '%s'", cmd)
+	// Keep the error as is to tell timeouts and cancellations apart
+	return br, err
+}
+
+// describe fills the fields of br that tell which request it is the result of.
+func (b *build) describe(req *buildReq, br *store.BuildResult) {
+	br.Queued = req.queued
+	br.SHA1 = req.notif.sha1
+	br.Project = b.project
+	br.Stage = b.stage
+	br.Ticket = b.ticketNo
+	br.Trigger = req.notif.trigger
+	br.User = req.notif.user
+	br.Token = req.token
 }
 
 func (b *build) persist(cmd *command, req *buildReq, br *store.BuildResult) error {
 	// Fill and persist the build result
+	b.describe(req, br)
 	br.Cmd = cmd.String()
 	br.Act = req.act
 	br.Branch = b.branch
-	br.SHA1 = req.notif.sha1
-	br.Stage = b.stage
-	br.Ticket = b.ticketNo
 	if err := b.srv.storage.Add(br); err != nil {
 		return fmt.Errorf("cannot persist build result: %s", err)
 	}
@@ -289,38 +366,226 @@ func (b *build) persist(cmd *command, req *buildReq, br *store.BuildResult) erro
 }
 
 func (b *build) doReq(req *buildReq) {
+	branch := b.branch
 	b.prepare(req)
+	// A change of branch can change the URL
+	if req.act != store.BuildActDestroy {
+		b.srv.urls.set(b.stage, b.links(b.branch))
+	}
+	log := b.reqLogger(req)
 	cmd := newCommand(req.act, b)
 	if cmd == nil {
-		b.srv.log.Printf("[build] %s: nothing to do", req)
+		log.Printf("[build] nothing to do")
+		b.reportStatus(req, nil, nil)
 		return
 	}
+	m := b.srv.metrics
+	m.buildsStarted.inc(req.act.String())
 	br, err := b.execute(cmd, req)
-	if err != nil {
-		b.srv.log.Printf("[build] %s: build failed: %s", req, err)
+	m.buildsDone.inc(req.act.String())
+	status := resultStatus(err)
+	switch status {
+	case store.BuildStatusCancelled:
+		m.buildsCancelled.inc(req.act.String())
+		log.Printf("[build] build cancelled")
+		// The next request has to do again what this one did not complete
+		if req.act == store.BuildActCreate {
+			b.uncreated = true
+		} else if req.act == store.BuildActChange {
+			b.setBranch(branch)
+		}
+	case store.BuildStatusTimedOut:
+		m.buildsFailed.inc(req.act.String())
+		log.Errorf("[build] build timed out after %s", time.Duration(b.srv.config().CommandTimeout))
+	case store.BuildStatusFailed:
+		m.buildsFailed.inc(req.act.String())
+		log.Errorf("[build] build failed: %s", err)
+	case store.BuildStatusError:
+		m.buildsFailed.inc(req.act.String())
+		log.Errorf("[build] cannot start build: %s", err)
+		now := time.Now()
+		br = &store.BuildResult{Start: now, End: now, Stderr: []byte(err.Error())}
+	default:
+		b.uncreated = false
 	}
+	req.result = br
 	// If the build failed but there is a result to save.
 	if br != nil {
+		br.Status = status
+		if status != store.BuildStatusSuccess && status != store.BuildStatusFailed {
+			// Killed or never started
+			br.Retval = -1
+		}
+		if status != store.BuildStatusError {
+			m.durations.observe(req.act.String(), br.Duration().Seconds())
+		}
 		if err := b.persist(cmd, req, br); err != nil {
-			b.srv.log.Printf("[build] %s: build persistance failed: %s", req, err)
+			log.Errorf("[build] build persistance failed: %s", err)
 		}
 	}
+	b.srv.notifyBuild(newBuildEvent(b, req, br, err))
+	b.reportStatus(req, br, err)
+}
+
+// reportStatus sets the commit status at the end of a build. Destroys are
+// not reported as they happen on behalf of another commit.
+func (b *build) reportStatus(req *buildReq, br *store.BuildResult, err error) {
+	if req.act == store.BuildActDestroy {
+		return
+	}
+	state, desc, path := statusSuccess, fmt.Sprintf("%s succeeded", req.act), b.livePath()
+	switch resultStatus(err) {
+	case store.BuildStatusCancelled:
+		state, desc = statusCancelled, fmt.Sprintf("%s cancelled", req.act)
+	case store.BuildStatusTimedOut:
+		state, desc = statusFailure, fmt.Sprintf("%s timed out", req.act)
+	case store.BuildStatusFailed:
+		state, desc = statusFailure, fmt.Sprintf("%s failed", req.act)
+	case store.BuildStatusError:
+		state, desc = statusFailure, fmt.Sprintf("%s could not start", req.act)
+	}
+	if br == nil && err == nil {
+		desc = "nothing to deploy"
+	}
+	if br != nil && br.ID > 0 {
+		stream := "stdout"
+		if err != nil {
+			stream = "stderr"
+		}
+		path = b.outputPath(br.ID, stream)
+	}
+	b.srv.reportStatus(b.newCommitStatus(req, state, desc, path))
+}
+
+// actRank orders the acts that can replace each other: a newer request
+// must still create the stage or change its branch if the skipped one would have.
+var actRank = map[store.BuildAct]int{
+	store.BuildActUpdate: 0,
+	store.BuildActChange: 1,
+	store.BuildActCreate: 2,
+}
+
+// coalesce returns the pending requests with req added. Only the newest
+// of consecutive deployments is kept, the others are skipped.
+func (b *build) coalesce(pending []*buildReq, req *buildReq) []*buildReq {
+	last := len(pending) - 1
+	if last < 0 || req.act == store.BuildActDestroy || pending[last].act == store.BuildActDestroy {
+		return append(pending, req)
+	}
+	old := pending[last]
+	if actRank[old.act] > actRank[req.act] {
+		req.act = old.act
+	}
+	b.skip(old, req)
+	pending[last] = req
+	return pending
+}
+
+// supersedes returns true if req makes the running request obsolete.
+// act is the act of running before it started.
+func supersedes(req, running *buildReq, act store.BuildAct) bool {
+	if running == nil || act == store.BuildActDestroy {
+		return false
+	}
+	return req.act == store.BuildActDestroy || req.notif.sha1 != running.notif.sha1
 }
 
+// skip records that old will not run as req supersedes it.
+func (b *build) skip(old, req *buildReq) {
+	log := b.reqLogger(old)
+	log.Printf("[build] skipped, superseded by %s", req.notif.sha1)
+	b.srv.metrics.buildsSkipped.inc(old.act.String())
+	now := time.Now()
+	br := &store.BuildResult{
+		Start:  now,
+		End:    now,
+		Act:    old.act,
+		Status: store.BuildStatusSkipped,
+		Branch: old.notif.branch,
+	}
+	b.describe(old, br)
+	if err := b.srv.storage.Add(br); err != nil {
+		log.Errorf("[build] cannot persist skipped build: %s", err)
+	}
+	old.result = br
+	// The same commit might be deployed by req
+	if old.notif.sha1 != req.notif.sha1 {
+		b.srv.reportStatus(b.newCommitStatus(old, statusSkipped, fmt.Sprintf("skipped, superseded by %s", shortSHA1(req.notif.sha1)), b.livePath()))
+	}
+	old.done()
+}
+
+// run accepts requests at any time and keeps them pending while
+// the previous one is running. Consecutive pending deployments
+// are collapsed to the newest one and a running deployment is
+// cancelled by a newer one or by a destroy.
 func (b *build) run() {
-	for req := range b.reqs {
+	var (
+		pending    []*buildReq
+		busy       bool
+		running    *buildReq
+		runningAct store.BuildAct
+		reqs       = b.reqs
+		work       = make(chan *buildReq)
+		idle       = make(chan struct{})
+	)
+	go b.work(work, idle)
+	for reqs != nil || len(pending) > 0 || busy {
+		var (
+			next     chan *buildReq
+			first    *buildReq
+			firstAct store.BuildAct
+		)
+		if !busy && len(pending) > 0 {
+			next, first, firstAct = work, pending[0], pending[0].act
+		}
+		select {
+		case req, ok := <-reqs:
+			if !ok {
+				reqs = nil
+				continue
+			}
+			if supersedes(req, running, runningAct) {
+				b.reqLogger(running).Printf("[build] cancelling, superseded by %s", req.notif.sha1)
+				running.cancel()
+			}
+			pending = b.coalesce(pending, req)
+		case next <- first:
+			pending = pending[1:]
+			busy, running, runningAct = true, first, firstAct
+		case <-idle:
+			busy, running = false, nil
+		}
+	}
+	close(work)
+	b.srv.lives.del(b.stage)
+	b.logger().Printf("[build] terminated")
+	close(b.finished)
+}
+
+// work runs the requests one at a time, after the build previously
+// using the same stage has finished.
+func (b *build) work(work <-chan *buildReq, idle chan<- struct{}) {
+	if b.prev != nil {
+		<-b.prev
+	}
+	for req := range work {
 		b.srv.startBuild()
 		b.doReq(req)
 		b.srv.stopBuild()
 		req.done()
+		idle <- struct{}{}
 	}
-	b.srv.log.Printf("[build] %s: terminated", b)
 }
 
-func (b *build) request(act store.BuildAct, n *notif) {
-	br := newBuildReq(act, n)
+// enqueue adds a request without waiting for it to run. after is
+// called with the result, nil if nothing ran, when it is done.
+func (b *build) enqueue(act store.BuildAct, n *notif, token int64, after func(*store.BuildResult)) {
+	br := newBuildReq(act, n, token, after)
+	if act != store.BuildActDestroy {
+		b.srv.reportStatus(b.newCommitStatus(br, statusPending, "queued", b.livePath()))
+	}
 	b.reqs <- br
-	br.wait()
 }
 
 func (b *build) destroy() {
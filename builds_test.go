@@ -0,0 +1,161 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestBuildLinks(t *testing.T) {
+	s := &server{
+		conf: &config{
+			regexBranch: regexp.MustCompile(`^(?:[A-Z0-9]+\-)?(\d+)\-`),
+			Envs: map[string]envConfig{
+				"projectNemo": {
+					Branches: map[string][]string{"__default__": {"{ENV}.ticket{TICKET}"}},
+					URL:      "https://{STAGE}.example.test/{BRANCH}",
+				},
+			},
+		},
+		log: discardLogger,
+	}
+	bs, err := newBuilds(newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := bs[0].links("NEMO-12-test")
+	if links.URL != "https://projectNemo.ticket12.example.test/NEMO-12-test" {
+		t.Errorf("unexpected URL %s", links.URL)
+	}
+	if links.Redeploy != "projectNemo/jenkins/git/notifyCommit?branches=NEMO-12-test&sha1=0ff715f" {
+		t.Errorf("unexpected redeploy link %s", links.Redeploy)
+	}
+}
+
+func TestBuildCoalesce(t *testing.T) {
+	s := &server{
+		conf:    &config{},
+		storage: store.NewMemory(),
+		metrics: newMetrics(),
+		log:     discardLogger,
+	}
+	b := &build{project: "projectNemo", stage: "projectNemo.ticket12", branch: "NEMO-12-test", srv: s}
+	var skipped []*store.BuildResult
+	req := func(act store.BuildAct, sha1 string) *buildReq {
+		return newBuildReq(act, newNotif("projectNemo", sha1, "NEMO-12-test", notifPush), 1, func(br *store.BuildResult) {
+			skipped = append(skipped, br)
+		})
+	}
+	var pending []*buildReq
+	pending = b.coalesce(pending, req(store.BuildActCreate, "0ff715f"))
+	pending = b.coalesce(pending, req(store.BuildActChange, "1ee824e"))
+	pending = b.coalesce(pending, req(store.BuildActDestroy, ""))
+	pending = b.coalesce(pending, req(store.BuildActChange, "2dd933d"))
+	pending = b.coalesce(pending, req(store.BuildActUpdate, "3cc042c"))
+	if len(pending) != 3 {
+		t.Fatalf("expected three pending requests, got %d", len(pending))
+	}
+	// Acts that would have created the stage or changed branch are kept
+	for i, act := range []store.BuildAct{store.BuildActCreate, store.BuildActDestroy, store.BuildActChange} {
+		if pending[i].act != act {
+			t.Errorf("pending request %d: expected %s, got %s", i, act, pending[i].act)
+		}
+	}
+	if pending[0].notif.sha1 != "1ee824e" || pending[2].notif.sha1 != "3cc042c" {
+		t.Errorf("newest revisions not kept: %s, %s", pending[0].notif.sha1, pending[2].notif.sha1)
+	}
+	if len(skipped) != 2 || skipped[0].SHA1 != "0ff715f" || skipped[1].SHA1 != "2dd933d" {
+		t.Fatalf("unexpected skipped requests %+v", skipped)
+	}
+	brs, err := s.storage.Get(b.stage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(brs) != 2 || brs[0].Act != store.BuildActCreate || brs[0].Status != store.BuildStatusSkipped {
+		t.Errorf("skipped requests not recorded: %+v", brs)
+	}
+}
+
+func TestBuildSupersedes(t *testing.T) {
+	req := func(act store.BuildAct, sha1 string) *buildReq {
+		return newBuildReq(act, newNotif("projectNemo", sha1, "NEMO-12-test", notifPush), 1, nil)
+	}
+	running := req(store.BuildActChange, "0ff715f")
+	tests := []struct {
+		req  *buildReq
+		act  store.BuildAct
+		want bool
+	}{
+		{req(store.BuildActChange, "1ee824e"), store.BuildActChange, true},
+		{req(store.BuildActUpdate, "0ff715f"), store.BuildActChange, false},
+		{req(store.BuildActDestroy, ""), store.BuildActCreate, true},
+		{req(store.BuildActChange, "1ee824e"), store.BuildActDestroy, false},
+	}
+	for i, tt := range tests {
+		if got := supersedes(tt.req, running, tt.act); got != tt.want {
+			t.Errorf("%d: expected %v, got %v", i, tt.want, got)
+		}
+	}
+	if supersedes(req(store.BuildActDestroy, ""), nil, store.BuildActCreate) {
+		t.Error("nothing running cannot be superseded")
+	}
+}
+
+func TestBuildCancel(t *testing.T) {
+	s := NewServer(newTestConfig(commandsConfig{
+		CmdCreate:  []string{"sleep", "30"},
+		CmdDestroy: []string{"true"},
+	}, "projectNemo"))
+	bs, err := newBuilds(newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bs[0]
+	go b.run()
+	b.enqueue(store.BuildActCreate, newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush), 1, nil)
+	// Wait for the create command to run
+	waitFor(t, "create command started", func() bool {
+		return s.lives.get(b.stage) != nil
+	})
+	b.enqueue(store.BuildActDestroy, newNotif("projectNemo", "", "NEMO-12-test", notifDelete), 2, nil)
+	b.destroy()
+	select {
+	case <-b.finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("create command not cancelled")
+	}
+	brs, err := s.storage.Get(b.stage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(brs) != 2 || brs[0].Status != store.BuildStatusCancelled || brs[1].Act != store.BuildActDestroy {
+		t.Errorf("unexpected build results %+v", brs)
+	}
+}
+
+func TestBuildStartError(t *testing.T) {
+	s := NewServer(newTestConfig(commandsConfig{
+		CmdCreate: []string{"/nonexistent/deploy-tool", "{STAGE}"},
+	}, "projectNemo"))
+	n := newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush).triggered(store.BuildTriggerWebhook, "")
+	bs, err := newBuilds(n, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bs[0]
+	req := newBuildReq(store.BuildActCreate, n, 1, nil)
+	b.doReq(req)
+	br := req.result
+	if br == nil || br.ID == 0 {
+		t.Fatal("expected a persisted result")
+	}
+	if br.Status != store.BuildStatusError || br.Retval != -1 || br.Trigger != store.BuildTriggerWebhook || br.Project != "projectNemo" {
+		t.Errorf("unexpected build result %+v", br)
+	}
+}
@@ -5,23 +5,98 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/dullgiulio/umarell"
 )
 
+type reloader interface {
+	Reload() error
+}
+
+func reloadOnHangup(r reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Printf("SIGHUP received, reloading configuration")
+		if err := r.Reload(); err != nil {
+			log.Printf("configuration not reloaded: %s", err)
+		}
+	}
+}
+
+// checkConfig validates a configuration file and prints all errors found.
+func checkConfig(fname string) int {
+	if fname == "" {
+		fmt.Fprintln(os.Stderr, "usage: umarell-ci check-config FILE")
+		return 2
+	}
+	cfg, err := umarell.NewConfigFile(fname)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	for _, w := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "%s: warning: %s\n", fname, w)
+	}
+	fmt.Printf("%s: configuration is valid\n", fname)
+	return 0
+}
+
+// hashSecret reads a password from standard input and prints its hash.
+func hashSecret() int {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		fmt.Fprintf(os.Stderr, "cannot read password: %s\n", err)
+		return 1
+	}
+	hash, err := umarell.HashSecret(strings.TrimRight(line, "\r\n"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println(hash)
+	return 0
+}
+
+// newToken prints a new API token and the hash to configure.
+func newToken() int {
+	token, hash, err := umarell.NewToken()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("token: %s\nhash:  %s\n", token, hash)
+	return 0
+}
+
 func main() {
 	listen := flag.String("listen", ":8111", "Listen to `[ADDR]:PORT`")
 	flag.Parse()
 	conffile := flag.Arg(0)
+	switch conffile {
+	case "check-config":
+		os.Exit(checkConfig(flag.Arg(1)))
+	case "hash-secret":
+		os.Exit(hashSecret())
+	case "new-token":
+		os.Exit(newToken())
+	}
 
-	cfg, err := umarell.NewConfigJSONFile(conffile)
+	cfg, err := umarell.NewConfigFile(conffile)
 	if err != nil {
 		log.Fatal("configuration file failed to load: ", err)
 	}
 	srv := umarell.NewServer(cfg)
 	go srv.ServeReqs()
+	go reloadOnHangup(srv)
 	log.Printf("Listening to port %s", *listen)
 	srv.ServeHTTP(*listen)
 }
@@ -8,7 +8,8 @@ package umarell
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"path/filepath"
+	"regexp"
 	"time"
 )
 
@@ -30,42 +31,87 @@ func (d *duration) UnmarshalJSON(b []byte) error {
 	return err
 }
 
+type commandsConfig struct {
+	CmdChange  []string `json:"change"`
+	CmdCreate  []string `json:"create"`
+	CmdUpdate  []string `json:"update"`
+	CmdDestroy []string `json:"destroy"`
+}
+
+type envConfig struct {
+	Branches map[string][]string `json:"branches"`
+	Statics  []string            `json:"staticBranches"`
+	Merges   map[string]string   `json:"merges"` // branch : dir
+	// Repository name or URL as reported by the forge webhooks
+	Repository    string          `json:"repository"`
+	WebhookSecret string          `json:"webhook_secret"`
+	Commands      *commandsConfig `json:"commands"`
+	// Where stages are deployed, can use the same placeholders as commands
+	URL string `json:"url"`
+	// Notifications sent when builds finish
+	Notify []notifyConfig `json:"notify"`
+	// Report the status of builds on the pushed commits
+	Status *statusConfig `json:"commit_status"`
+	// API tokens valid only for this project
+	Tokens []tokenConfig `json:"tokens"`
+}
+
 type config struct {
-	BranchRegexp    string   `json:"branch_regexp"`
-	WorkspacesDir   string   `json:"workspaces_dir"`
-	Database        string   `json:"database"`
-	Table           string   `json:"table"`
-	LimitBuilds     int      `json:"limit_builds"`
-	ResultsDuration duration `json:"results_duration"`
-	ResultsCleanup  duration `json:"results_cleanup"`
-	CommandTimeout  duration `json:"command_timeout"`
-	Commands        struct {
-		CmdChange  []string `json:"change"`
-		CmdCreate  []string `json:"create"`
-		CmdUpdate  []string `json:"update"`
-		CmdDestroy []string `json:"destroy"`
-	} `json:"commands"`
-	Envs map[string]struct {
-		Branches map[string][]string `json:"branches"`
-		Statics  []string            `json:"staticBranches"`
-		Merges   map[string]string   `json:"merges"` // branch : dir
-		Commands *struct {
-			CmdChange  []string `json:"change"`
-			CmdCreate  []string `json:"create"`
-			CmdUpdate  []string `json:"update"`
-			CmdDestroy []string `json:"destroy"`
-		} `json:"commands"`
-	} `json:"environments"`
+	BranchRegexp    string               `json:"branch_regexp"`
+	WorkspacesDir   string               `json:"workspaces_dir"`
+	Database        string               `json:"database"`
+	Table           string               `json:"table"`
+	StateFile       string               `json:"state_file"`
+	PublicURL       string               `json:"public_url"` // base URL of links to this server
+	LogFormat       string               `json:"log_format"` // text, logfmt or json
+	LogLevel        string               `json:"log_level"`  // debug, info or error
+	LimitBuilds     int                  `json:"limit_builds"`
+	QueueSize       int                  `json:"queue_size"`    // notifications waiting to be handled
+	QueueJournal    string               `json:"queue_journal"` // file keeping queued notifications across restarts
+	ResultsDuration duration             `json:"results_duration"`
+	ResultsCleanup  duration             `json:"results_cleanup"`
+	CommandTimeout  duration             `json:"command_timeout"`
+	KillSignal      string               `json:"kill_signal"` // sent to stop commands, SIGTERM if empty
+	KillGrace       duration             `json:"kill_grace"`  // before stopped commands are killed, or their output closed
+	Commands        commandsConfig       `json:"commands"`
+	Envs            map[string]envConfig `json:"environments"`
+	Auth            *authConfig          `json:"auth"`
+	// Files defining one project each, named after the file
+	Include         []string `json:"include"`
+	EnvironmentsDir string   `json:"environments_dir"`
+	// File the configuration was loaded from
+	fname       string
+	regexBranch *regexp.Regexp
 }
 
-func NewConfigJSONFile(fname string) (*config, error) {
-	file, err := ioutil.ReadFile(fname)
+// NewConfigFile loads and validates a configuration file. The format,
+// JSON, YAML or TOML, is selected by the file extension. Environment
+// variables are expanded and included project files are loaded.
+func NewConfigFile(fname string) (*config, error) {
+	data, src, err := readConfigFile(fname)
 	if err != nil {
 		return nil, err
 	}
 	var c config
-	if err = json.Unmarshal(file, &c); err != nil {
+	if err = json.Unmarshal(data, &c); err != nil {
+		return nil, jsonError(fname, data, src.pos, err)
+	}
+	incs, err := c.loadIncludes(filepath.Dir(fname))
+	if err != nil {
 		return nil, err
 	}
+	if errs := c.check(); len(errs) > 0 {
+		errs.locate(append(incs, src)...)
+		return nil, errs
+	}
+	c.regexBranch = regexp.MustCompile(c.BranchRegexp)
+	c.fname = fname
 	return &c, nil
 }
+
+// NewConfigJSONFile loads and validates a configuration file.
+//
+// Deprecated: use NewConfigFile, that also reads YAML and TOML files.
+func NewConfigJSONFile(fname string) (*config, error) {
+	return NewConfigFile(fname)
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Matches ${VAR} and the escape sequence $${ that produces a literal ${
+var envVarRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} in all strings of v with the value of the
+// environment variable VAR. Undefined variables are reported in errs.
+func expandEnv(v interface{}, path string, errs *configErrors) interface{} {
+	switch val := v.(type) {
+	case string:
+		return envVarRegexp.ReplaceAllStringFunc(val, func(m string) string {
+			if m == "$${" {
+				return "${"
+			}
+			name := m[2 : len(m)-1]
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				errs.add(path, "environment variable %s is not defined", name)
+			}
+			return env
+		})
+	case []interface{}:
+		for i := range val {
+			val[i] = expandEnv(val[i], fmt.Sprintf("%s[%d]", path, i), errs)
+		}
+	case map[string]interface{}:
+		for k := range val {
+			kpath := k
+			if path != "" {
+				kpath = path + "." + k
+			}
+			val[k] = expandEnv(val[k], kpath, errs)
+		}
+	}
+	return v
+}
+
+// readConfigFile decodes a configuration file of any supported format
+// to JSON, after expanding environment variables.
+func readConfigFile(fname string) ([]byte, *configSource, error) {
+	decode, err := configDecoderFor(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	file, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, pos, err := decode(fname, file)
+	if err != nil {
+		return nil, nil, err
+	}
+	src := newConfigSource(fname, pos, "")
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, nil, jsonError(fname, data, pos, err)
+	}
+	var errs configErrors
+	v = expandEnv(v, "", &errs)
+	if len(errs) > 0 {
+		errs.locate(src)
+		return nil, nil, errs
+	}
+	data, err = json.Marshal(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return data, src, nil
+}
+
+// includedFiles returns the project files to load, sorted by name.
+// Relative paths are relative to the directory of the main configuration.
+func (c *config) includedFiles(dir string) ([]string, error) {
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	patterns := make([]string, 0, len(c.Include)+len(configDecoders))
+	for _, inc := range c.Include {
+		patterns = append(patterns, abs(inc))
+	}
+	if c.EnvironmentsDir != "" {
+		edir := abs(c.EnvironmentsDir)
+		if fi, err := os.Stat(edir); err != nil || !fi.IsDir() {
+			return nil, fmt.Errorf("environments_dir: %s is not a directory", edir)
+		}
+		for ext := range configDecoders {
+			patterns = append(patterns, filepath.Join(edir, "*"+ext))
+		}
+	}
+	files := make([]string, 0)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include: %s: %s", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// loadIncludes adds the projects defined in their own files. The name
+// of each project is the name of its file without extension.
+func (c *config) loadIncludes(dir string) ([]*configSource, error) {
+	files, err := c.includedFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 && c.Envs == nil {
+		c.Envs = make(map[string]envConfig)
+	}
+	srcs := make([]*configSource, 0, len(files))
+	for _, fname := range files {
+		name := strings.TrimSuffix(filepath.Base(fname), filepath.Ext(fname))
+		if _, ok := c.Envs[name]; ok {
+			return nil, fmt.Errorf("%s: project %s is already defined", fname, name)
+		}
+		data, src, err := readConfigFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		var env envConfig
+		if err := json.Unmarshal(data, &env); err != nil {
+			return nil, jsonError(fname, data, src.pos, err)
+		}
+		c.Envs[name] = env
+		src.prefix = "environments." + name
+		srcs = append(srcs, src)
+	}
+	return srcs, nil
+}
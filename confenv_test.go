@@ -0,0 +1,81 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("UMARELL_TEST_PASSWORD", "s3cret")
+	defer os.Unsetenv("UMARELL_TEST_PASSWORD")
+
+	v := map[string]interface{}{
+		"database": "user:${UMARELL_TEST_PASSWORD}@tcp(localhost:3306)/db",
+		"commands": map[string]interface{}{
+			"create": []interface{}{"sh", "-c", "echo $${HOME}", "${UMARELL_TEST_UNDEFINED}"},
+		},
+	}
+	var errs configErrors
+	expandEnv(v, "", &errs)
+	if db := v["database"]; db != "user:s3cret@tcp(localhost:3306)/db" {
+		t.Errorf("unexpected expansion %s", db)
+	}
+	create := v["commands"].(map[string]interface{})["create"].([]interface{})
+	if create[2] != "echo ${HOME}" {
+		t.Errorf("unexpected escape expansion %s", create[2])
+	}
+	if len(errs) != 1 || errs[0].path != "commands.create[3]" {
+		t.Errorf("expected error for undefined variable, got %v", errs)
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umarell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "projects.d"), 0755)
+
+	files := map[string]string{
+		"config.json":            `{"branch_regexp": "^(\\d+)-", "command_timeout": "1m", "environments_dir": "projects.d"}`,
+		"projects.d/nemo.yaml":   "branches:\n  __default__: ['{ENV}.ticket{TICKET}']\n",
+		"projects.d/dory.toml":   "[branches]\n__default__ = [\"{ENV}.{SHARK}\"]\n",
+		"projects.d/ignored.txt": "not a project",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = NewConfigFile(filepath.Join(dir, "config.json"))
+	if err == nil || !strings.Contains(err.Error(), "dory.toml: branches.__default__[0]: unknown placeholder {SHARK}") {
+		t.Fatalf("expected error in included file, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "projects.d/dory.toml"))
+	c, err := NewConfigFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Envs) != 1 || c.Envs["nemo"].Branches["__default__"][0] != "{ENV}.ticket{TICKET}" {
+		t.Errorf("unexpected environments %+v", c.Envs)
+	}
+}
+
+func TestCheckPlaceholders(t *testing.T) {
+	var errs configErrors
+	checkPlaceholders(&errs, "commands.create", []string{"{ENV}{FOO}", "${HOME}/{STAGE}", "{BAR}"}, commandPlaceholders)
+	if len(errs) != 2 || errs[0].path != "commands.create[0]" || errs[1].path != "commands.create[2]" {
+		t.Fatalf("expected errors for {FOO} and {BAR}, got %v", errs)
+	}
+	if !strings.Contains(errs[0].msg, "{FOO}") {
+		t.Errorf("unexpected error %s", errs[0].msg)
+	}
+}
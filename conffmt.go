@@ -0,0 +1,104 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// configDecoder converts a configuration document to JSON, that is then
+// decoded into the config struct. It also returns the position of all keys
+// in the original document, if known.
+type configDecoder func(fname string, data []byte) ([]byte, positions, error)
+
+var configDecoders = map[string]configDecoder{
+	".json": decodeJSONConfig,
+	".yaml": decodeYAMLConfig,
+	".yml":  decodeYAMLConfig,
+	".toml": decodeTOMLConfig,
+}
+
+func configDecoderFor(fname string) (configDecoder, error) {
+	ext := strings.ToLower(filepath.Ext(fname))
+	dec, ok := configDecoders[ext]
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown configuration format %s, use .json, .yaml or .toml", fname, ext)
+	}
+	return dec, nil
+}
+
+func decodeJSONConfig(fname string, data []byte) ([]byte, positions, error) {
+	return data, jsonPositions(data), nil
+}
+
+func decodeYAMLConfig(fname string, data []byte) ([]byte, positions, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, configErrors{&configError{file: fname, msg: err.Error()}}
+	}
+	pos := make(positions)
+	walkYAML(&root, "", pos)
+	var v interface{}
+	if err := root.Decode(&v); err != nil {
+		return nil, nil, configErrors{&configError{file: fname, msg: err.Error()}}
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return js, pos, nil
+}
+
+func walkYAML(n *yaml.Node, path string, pos positions) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			walkYAML(c, path, pos)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			kpath := key.Value
+			if path != "" {
+				kpath = path + "." + kpath
+			}
+			pos[kpath] = filePos{key.Line, key.Column}
+			walkYAML(n.Content[i+1], kpath, pos)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			ipath := fmt.Sprintf("%s[%d]", path, i)
+			pos[ipath] = filePos{c.Line, c.Column}
+			walkYAML(c, ipath, pos)
+		}
+	}
+}
+
+// TOML keys are reported without position.
+func decodeTOMLConfig(fname string, data []byte) ([]byte, positions, error) {
+	var v map[string]interface{}
+	if _, err := toml.Decode(string(data), &v); err != nil {
+		if pe, ok := err.(toml.ParseError); ok {
+			msg := pe.Message
+			if msg == "" {
+				msg = pe.Error()
+			}
+			line, col := lineCol(data, int64(pe.Position.Start))
+			return nil, nil, configErrors{&configError{file: fname, line: line, col: col, msg: msg}}
+		}
+		return nil, nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", fname, err)
+	}
+	return js, nil, nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func decodeExampleConfig(t *testing.T, fname string) *config {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := configDecoderFor(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, _, err := dec(fname, data)
+	if err != nil {
+		t.Fatalf("%s: %s", fname, err)
+	}
+	var c config
+	if err := json.Unmarshal(js, &c); err != nil {
+		t.Fatalf("%s: %s", fname, err)
+	}
+	return &c
+}
+
+func TestConfigFormats(t *testing.T) {
+	expected := decodeExampleConfig(t, "examples/config.json")
+	for _, fname := range []string{"examples/config.yaml", "examples/config.toml"} {
+		c := decodeExampleConfig(t, fname)
+		if !reflect.DeepEqual(expected, c) {
+			t.Errorf("%s: configuration differs from JSON:\n%+v\n%+v", fname, expected, c)
+		}
+	}
+}
+
+func TestConfigYAMLPositions(t *testing.T) {
+	data := []byte("command_timeout: 10m\nenvironments:\n  nemo:\n    branches:\n      __default__: ['{ENV}.{FOO}']\n")
+	_, pos, err := decodeYAMLConfig("config.yaml", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, ok := pos.lookup("environments.nemo.branches.__default__[0]")
+	if !ok || fp.line != 5 || fp.col != 21 {
+		t.Errorf("unexpected position %+v", fp)
+	}
+}
+
+func TestConfigYAMLDuration(t *testing.T) {
+	js, _, err := decodeYAMLConfig("config.yaml", []byte("command_timeout: 600000000000\nresults_cleanup: 30m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c config
+	if err := json.Unmarshal(js, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.CommandTimeout != duration(600000000000) || c.ResultsCleanup != duration(1800000000000) {
+		t.Errorf("unexpected durations %d %d", c.CommandTimeout, c.ResultsCleanup)
+	}
+}
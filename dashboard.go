@@ -0,0 +1,134 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Seconds between automatic reloads of the dashboard
+const dashboardRefresh = 30
+
+// ago returns how long ago t was in a short human readable form.
+func ago(now, t time.Time) string {
+	d := now.Sub(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	}
+	return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+}
+
+func shortSHA1(sha1 string) string {
+	if len(sha1) > 8 {
+		return sha1[:8]
+	}
+	return sha1
+}
+
+type dashboardStage struct {
+	*stageJSON
+	Static bool
+}
+
+type dashboardProject struct {
+	Name   string
+	Stages []*dashboardStage
+}
+
+type dashboard struct {
+	Projects []*dashboardProject
+	Refresh  int
+	Now      time.Time
+}
+
+func (s *server) newDashboard() *dashboard {
+	d := &dashboard{Refresh: dashboardRefresh, Now: time.Now()}
+	var pro *dashboardProject
+	// Stages are sorted by project
+	for _, st := range s.stages() {
+		if pro == nil || pro.Name != st.Project {
+			pro = &dashboardProject{Name: st.Project}
+			d.Projects = append(d.Projects, pro)
+		}
+		pro.Stages = append(pro.Stages, &dashboardStage{
+			stageJSON: st,
+			Static:    s.isStatic(st.Project, st.Branch),
+		})
+	}
+	return d
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ago":   ago,
+	"short": shortSHA1,
+	"path":  url.PathEscape,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>Umarell environments</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 2em; }
+th, td { text-align: left; padding: .4em .8em; border-bottom: 1px solid #ddd; }
+th { background: #f4f4f4; }
+code { font-size: .9em; }
+.success { color: #1a7f37; }
+.failed, .timeout { color: #cf222e; }
+.none, .skipped, .cancelled { color: #888; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Environments</h1>
+{{range .Projects}}{{$project := .Name}}
+<h2>{{.Name}}</h2>
+<table>
+<tr><th>Stage</th><th>Branch</th><th>Ticket</th><th>Revision</th><th>Last build</th><th>Logs</th><th></th></tr>
+{{range .Stages}}{{$stage := .Stage}}<tr>
+<td>{{if .URL}}<a href="{{.URL}}">{{.Stage}}</a>{{else}}{{.Stage}}{{end}}</td>
+<td>{{.Branch}}</td>
+<td>{{if .Ticket}}{{.Ticket}}{{end}}</td>
+<td><code title="{{.SHA1}}">{{short .SHA1}}</code></td>
+{{with .LastBuild}}<td class="{{.Status}}">{{.Act}} {{.Status}}, <span title="{{.End.Format "2006-01-02 15:04:05"}}">{{ago $.Now .End}}</span>{{if .User}} by {{.User}}{{end}}</td>
+<td><a href="/{{path $project}}/stages/{{path $stage}}/builds/{{.ID}}/stdout">stdout</a>
+<a href="/{{path $project}}/stages/{{path $stage}}/builds/{{.ID}}/stderr">stderr</a>
+{{else}}<td class="none">never built</td><td>{{end}}
+<a href="/{{path $project}}/stages/{{path .Stage}}/live">live</a>
+<a href="/{{path $project}}/stages/{{path .Stage}}/builds">history</a></td>
+<td>{{if not .Static}}<form method="post" action="/{{path $project}}/delete?branches={{.Branch}}" onsubmit="return confirm('Destroy all stages of branch {{.Branch}}?')"><button type="submit">Destroy</button></form>{{end}}</td>
+</tr>
+{{end}}</table>
+{{else}}
+<p class="none">No live environments.</p>
+{{end}}
+</body>
+</html>
+`))
+
+func (s *server) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	s.log.Printf("[http] %s: serving dashboard", r.RemoteAddr)
+	var buf bytes.Buffer
+	if err := dashboardTemplate.Execute(&buf, s.newDashboard()); err != nil {
+		s.log.Errorf("[http] cannot render dashboard: %s", err)
+		http.Error(w, "cannot render dashboard", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		s.log.Errorf("[http] cannot write dashboard: %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestAgo(t *testing.T) {
+	now := time.Date(2016, 5, 3, 10, 0, 0, 0, time.UTC)
+	tests := map[time.Duration]string{
+		10 * time.Second: "just now",
+		5 * time.Minute:  "5m ago",
+		3 * time.Hour:    "3h ago",
+		72 * time.Hour:   "3d ago",
+	}
+	for d, expected := range tests {
+		if s := ago(now, now.Add(-d)); s != expected {
+			t.Errorf("%s: expected %s, got %s", d, expected, s)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	s := &server{
+		conf:    &config{Envs: map[string]envConfig{"projectNemo": {Statics: []string{"master"}}}},
+		storage: store.NewMemory(),
+		states:  newStageStates(nil, discardLogger),
+		urls:    newUrls(),
+		log:     discardLogger,
+	}
+	s.states.set(&stageState{Project: "projectNemo", Stage: "projectNemo.dev", Branch: "master"})
+	s.states.set(&stageState{Project: "projectNemo", Stage: "projectNemo.ticket12", Branch: "feature/NEMO-12-<b>", Ticket: 12, SHA1: "0ff715f31f275dcdc16762ae9e80c0afbb6c1be0"})
+	s.storage.Add(&store.BuildResult{Stage: "projectNemo.ticket12", Act: store.BuildActCreate, Retval: 1, Status: store.BuildStatusFailed, End: time.Now().Add(-5 * time.Minute)})
+
+	w := httptest.NewRecorder()
+	s.dashboardHandler(w, httptest.NewRequest("GET", "/", nil))
+	out := w.Body.String()
+	for _, s := range []string{
+		"<h2>projectNemo</h2>",
+		`<code title="0ff715f31f275dcdc16762ae9e80c0afbb6c1be0">0ff715f3</code>`,
+		`<td class="failed">create failed`,
+		"5m ago",
+		`href="/projectNemo/stages/projectNemo.ticket12/builds/1/stderr"`,
+		"feature/NEMO-12-&lt;b&gt;",
+		`action="/projectNemo/delete?branches=feature%2fNEMO-12-%3cb%3e"`,
+		"never built",
+	} {
+		if !strings.Contains(out, s) {
+			t.Errorf("dashboard does not contain %s:\n%s", s, out)
+		}
+	}
+	if strings.Count(out, "Destroy</button>") != 1 {
+		t.Error("expected a destroy button only for the dynamic stage")
+	}
+}
@@ -6,15 +6,63 @@ package umarell
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os/exec"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/dullgiulio/umarell/store"
 )
 
+// Time a stopped command has to exit before it is killed when kill_grace is not set
+const defaultKillGrace = 10 * time.Second
+
+var (
+	errCancelled = errors.New("command cancelled")
+	errTimeout   = errors.New("timeout while executing command")
+)
+
+// Signals that can be sent to stop commands gracefully
+var killSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+}
+
+// parseSignal returns the signal called name, with or without the SIG prefix.
+func parseSignal(name string) (syscall.Signal, bool) {
+	if name == "" {
+		return syscall.SIGTERM, true
+	}
+	sig, ok := killSignals["SIG"+strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+	return sig, ok
+}
+
+// killPolicy is how commands are stopped on timeout or cancellation:
+// signal is sent to the process group, then SIGKILL after grace.
+type killPolicy struct {
+	signal syscall.Signal
+	grace  time.Duration
+}
+
+var defaultKillPolicy = killPolicy{signal: syscall.SIGTERM, grace: defaultKillGrace}
+
+func (c *config) killPolicy() killPolicy {
+	kp := defaultKillPolicy
+	if sig, ok := parseSignal(c.KillSignal); ok {
+		kp.signal = sig
+	}
+	if c.KillGrace > 0 {
+		kp.grace = time.Duration(c.KillGrace)
+	}
+	return kp
+}
+
 type execError struct {
 	err  error
 	out  []byte
@@ -33,7 +81,59 @@ func (e *execError) Error() string {
 	return fmt.Sprintf("%s\n--OUTPUT--\n%s--OUTPUT--\n--ERROR--\n%s\n--ERROR--", e.err, e.out, e.eout)
 }
 
-func execResult(cmd *exec.Cmd, timeout time.Duration) (*store.BuildResult, error) {
+func causeOf(err error) error {
+	if e, ok := err.(*execError); ok {
+		return e.err
+	}
+	return err
+}
+
+// isCancelled returns true if err is returned by execResult for a cancelled command.
+func isCancelled(err error) bool {
+	return causeOf(err) == errCancelled
+}
+
+// isTimeout returns true if err is returned by execResult for a command that timed out.
+func isTimeout(err error) bool {
+	return causeOf(err) == errTimeout
+}
+
+// resultStatus returns the status of a build from the error of execResult.
+func resultStatus(err error) store.BuildStatus {
+	switch {
+	case err == nil:
+		return store.BuildStatusSuccess
+	case isCancelled(err):
+		return store.BuildStatusCancelled
+	case isTimeout(err):
+		return store.BuildStatusTimedOut
+	}
+	// Errors after the command started carry its output
+	if _, ok := err.(*execError); !ok {
+		return store.BuildStatusError
+	}
+	return store.BuildStatusFailed
+}
+
+// terminate stops the process group of cmd, forcefully if it does not exit in time.
+// It returns the result of cmd.Wait received from wait.
+func terminate(cmd *exec.Cmd, wait <-chan error, kp killPolicy) error {
+	pgid := -cmd.Process.Pid
+	syscall.Kill(pgid, kp.signal)
+	select {
+	case err := <-wait:
+		return err
+	case <-time.After(kp.grace):
+		syscall.Kill(pgid, syscall.SIGKILL)
+		return <-wait
+	}
+}
+
+// execResult runs cmd and collects its output in a build result. If live is
+// not nil, both stdout and stderr are also written to it as they are produced.
+// On timeout or when ctx is cancelled, the command and all its children are
+// stopped according to kp.
+func execResult(ctx context.Context, cmd *exec.Cmd, timeout time.Duration, kp killPolicy, live io.Writer) (*store.BuildResult, error) {
 	var err error
 	var out, errOut bytes.Buffer
 
@@ -41,6 +141,17 @@ func execResult(cmd *exec.Cmd, timeout time.Duration) (*store.BuildResult, error
 	over := make(chan struct{})
 	cmd.Stdout = &out
 	cmd.Stderr = &errOut
+	if live != nil {
+		cmd.Stdout = io.MultiWriter(&out, live)
+		cmd.Stderr = io.MultiWriter(&errOut, live)
+	}
+	// Children are in the same group and can be signalled together
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	// Children that left the group can keep the output open after the command exited
+	cmd.WaitDelay = kp.grace
 	br := &store.BuildResult{
 		Start: time.Now(),
 	}
@@ -51,16 +162,20 @@ func execResult(cmd *exec.Cmd, timeout time.Duration) (*store.BuildResult, error
 		select {
 		case err = <-wait:
 		case <-time.After(timeout):
-			if err = cmd.Process.Kill(); err != nil {
-				err = errors.New("timeout while executing command")
-			} else {
-				err = fmt.Errorf("timeout while executing command, kill process failed: %s", err)
-			}
-			<-wait
+			terminate(cmd, wait, kp)
+			err = errTimeout
+		case <-ctx.Done():
+			terminate(cmd, wait, kp)
+			err = errCancelled
 		}
 		over <- struct{}{}
 	}()
-	wait <- cmd.Wait()
+	werr := cmd.Wait()
+	// The command itself succeeded, the output after the delay is lost
+	if werr == exec.ErrWaitDelay {
+		werr = nil
+	}
+	wait <- werr
 	<-over
 	retval := 0
 	if e, ok := err.(*exec.ExitError); ok {
@@ -0,0 +1,80 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestExecResultCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	// The background sleep keeps the output open unless the whole group is stopped
+	cmd := exec.Command("sh", "-c", "sleep 30 & echo started; wait")
+	start := time.Now()
+	br, err := execResult(ctx, cmd, time.Minute, defaultKillPolicy, nil)
+	if !isCancelled(err) {
+		t.Fatalf("expected cancelled command, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancelled command took %s", d)
+	}
+	if string(br.Stdout) != "started\n" {
+		t.Errorf("unexpected output %q", br.Stdout)
+	}
+}
+
+func TestExecResultTimeout(t *testing.T) {
+	// The children ignore the signal and are killed after the grace period
+	kp := killPolicy{signal: syscall.SIGTERM, grace: 200 * time.Millisecond}
+	cmd := exec.Command("sh", "-c", "trap '' TERM; sleep 30 & wait")
+	start := time.Now()
+	br, err := execResult(context.Background(), cmd, 100*time.Millisecond, kp, nil)
+	if !isTimeout(err) || resultStatus(err) != store.BuildStatusTimedOut {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("timed out command took %s", d)
+	}
+	if br == nil || br.End.Sub(br.Start) < 300*time.Millisecond {
+		t.Errorf("command killed before the grace period")
+	}
+}
+
+func TestKillPolicy(t *testing.T) {
+	c := &config{KillSignal: "int", KillGrace: duration(time.Second)}
+	if kp := c.killPolicy(); kp.signal != syscall.SIGINT || kp.grace != time.Second {
+		t.Errorf("unexpected kill policy %+v", kp)
+	}
+	if _, ok := parseSignal("SIGSTOP"); ok {
+		t.Error("expected unknown signal")
+	}
+}
+
+func TestExecResultWaitDelay(t *testing.T) {
+	// The detached child keeps the output open after the command exited
+	kp := killPolicy{signal: syscall.SIGTERM, grace: 200 * time.Millisecond}
+	cmd := exec.Command("sh", "-c", "setsid sleep 10 & echo started")
+	start := time.Now()
+	br, err := execResult(context.Background(), cmd, time.Minute, kp, nil)
+	if err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("command waited for its detached child for %s", d)
+	}
+	if string(br.Stdout) != "started\n" {
+		t.Errorf("unexpected output %q", br.Stdout)
+	}
+}
@@ -7,14 +7,21 @@ package umarell
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dullgiulio/umarell/store"
 )
 
+// Git commands are quick, they are stopped after gitTimeout and killed soon after
+const gitTimeout = 2 * time.Second
+
+var gitKillPolicy = killPolicy{signal: syscall.SIGTERM, grace: time.Second}
+
 type githash []byte
 
 // When comparing hashes, truncate to the shortest one
@@ -81,7 +88,7 @@ func (g *gitcommits) branch(dir string) (string, error) {
 }
 
 func (g *gitcommits) exec(cmd *exec.Cmd) (*store.BuildResult, error) {
-	br, err := execResult(cmd, 2*time.Second)
+	br, err := execResult(context.Background(), cmd, gitTimeout, gitKillPolicy, nil)
 	if err != nil {
 		return nil, fmt.Errorf("exec error: %s: %s: %s", cmd.Dir, strings.Join(cmd.Args, " "), err)
 	}
@@ -0,0 +1,302 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dullgiulio/umarell/store"
+	"github.com/gorilla/mux"
+)
+
+// Maximum size of a webhook payload that we accept
+const maxHookPayload = 10 << 20
+
+// pushEvent is a forge independent representation of a pushed branch.
+// Deleted branches are pushed with the zero SHA1.
+type pushEvent struct {
+	repos  []string // names and URLs identifying the repository
+	branch string
+	sha1   string
+}
+
+func (e *pushEvent) String() string {
+	return fmt.Sprintf("%s: %s: %s", e.repos[0], e.branch, e.sha1)
+}
+
+type forge struct {
+	// isPush returns true if the request headers announce a push event
+	isPush func(h http.Header) bool
+	// verify checks the payload against the shared secret
+	verify func(h http.Header, body []byte, secret string) bool
+	parse  func(body []byte) ([]*pushEvent, error)
+}
+
+var forges = map[string]*forge{
+	"github": {
+		isPush: func(h http.Header) bool { return h.Get("X-GitHub-Event") == "push" },
+		verify: verifyHubSignature,
+		parse:  parseGithubPush,
+	},
+	"gitea": {
+		isPush: func(h http.Header) bool { return h.Get("X-Gitea-Event") == "push" },
+		verify: func(h http.Header, body []byte, secret string) bool {
+			return verifyHMAC(sha256.New, h.Get("X-Gitea-Signature"), body, secret)
+		},
+		parse: parseGithubPush,
+	},
+	"gitlab": {
+		isPush: func(h http.Header) bool { return h.Get("X-Gitlab-Event") == "Push Hook" },
+		verify: func(h http.Header, body []byte, secret string) bool {
+			return subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), []byte(secret)) == 1
+		},
+		parse: parseGitlabPush,
+	},
+	"bitbucket": {
+		isPush: func(h http.Header) bool { return h.Get("X-Event-Key") == "repo:push" },
+		verify: verifyHubSignature,
+		parse:  parseBitbucketPush,
+	},
+}
+
+func verifyHMAC(h func() hash.Hash, signature string, body []byte, secret string) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// verifyHubSignature checks the "sha256=" or legacy "sha1=" signature headers.
+func verifyHubSignature(h http.Header, body []byte, secret string) bool {
+	if sig := h.Get("X-Hub-Signature-256"); sig != "" {
+		return verifyHMAC(sha256.New, strings.TrimPrefix(sig, "sha256="), body, secret)
+	}
+	sig := h.Get("X-Hub-Signature")
+	switch {
+	case strings.HasPrefix(sig, "sha256="):
+		return verifyHMAC(sha256.New, strings.TrimPrefix(sig, "sha256="), body, secret)
+	case strings.HasPrefix(sig, "sha1="):
+		return verifyHMAC(sha1.New, strings.TrimPrefix(sig, "sha1="), body, secret)
+	}
+	return false
+}
+
+// branchRef returns the branch name of a ref or false if ref is not a branch.
+func branchRef(ref string) (string, bool) {
+	const prefix = "refs/heads/"
+	if !strings.HasPrefix(ref, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(ref, prefix), true
+}
+
+// GitHub and Gitea use the same format for push events.
+func parseGithubPush(body []byte) ([]*pushEvent, error) {
+	var p struct {
+		Ref        string `json:"ref"`
+		After      string `json:"after"`
+		Deleted    bool   `json:"deleted"`
+		Repository struct {
+			FullName string `json:"full_name"`
+			CloneURL string `json:"clone_url"`
+			SSHURL   string `json:"ssh_url"`
+			HTMLURL  string `json:"html_url"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	branch, ok := branchRef(p.Ref)
+	if !ok {
+		return nil, nil
+	}
+	if p.Deleted {
+		p.After = zeroSHA1
+	}
+	r := p.Repository
+	return []*pushEvent{{
+		repos:  []string{r.FullName, r.CloneURL, r.SSHURL, r.HTMLURL},
+		branch: branch,
+		sha1:   p.After,
+	}}, nil
+}
+
+func parseGitlabPush(body []byte) ([]*pushEvent, error) {
+	var p struct {
+		Ref     string `json:"ref"`
+		After   string `json:"after"`
+		Project struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			HTTPURL           string `json:"git_http_url"`
+			SSHURL            string `json:"git_ssh_url"`
+			WebURL            string `json:"web_url"`
+		} `json:"project"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	branch, ok := branchRef(p.Ref)
+	if !ok {
+		return nil, nil
+	}
+	r := p.Project
+	return []*pushEvent{{
+		repos:  []string{r.PathWithNamespace, r.HTTPURL, r.SSHURL, r.WebURL},
+		branch: branch,
+		sha1:   p.After,
+	}}, nil
+}
+
+type bitbucketRef struct {
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target struct {
+		Hash string `json:"hash"`
+	} `json:"target"`
+}
+
+// Bitbucket can report more than one branch in a single push event.
+func parseBitbucketPush(body []byte) ([]*pushEvent, error) {
+	var p struct {
+		Push struct {
+			Changes []struct {
+				Old *bitbucketRef `json:"old"`
+				New *bitbucketRef `json:"new"`
+			} `json:"changes"`
+		} `json:"push"`
+		Repository struct {
+			FullName string `json:"full_name"`
+			Links    struct {
+				HTML struct {
+					Href string `json:"href"`
+				} `json:"html"`
+			} `json:"links"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	repos := []string{p.Repository.FullName, p.Repository.Links.HTML.Href}
+	evs := make([]*pushEvent, 0, len(p.Push.Changes))
+	for _, c := range p.Push.Changes {
+		switch {
+		case c.New != nil && c.New.Type == "branch":
+			evs = append(evs, &pushEvent{repos: repos, branch: c.New.Name, sha1: c.New.Target.Hash})
+		case c.New == nil && c.Old != nil && c.Old.Type == "branch":
+			evs = append(evs, &pushEvent{repos: repos, branch: c.Old.Name, sha1: zeroSHA1})
+		}
+	}
+	return evs, nil
+}
+
+func normalizeRepo(repo string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSuffix(repo, "/")), ".git")
+}
+
+// repoProjects returns the names of the projects configured for any of repos.
+func (c *config) repoProjects(repos []string) []string {
+	names := make([]string, 0)
+	for name, env := range c.Envs {
+		if env.Repository == "" {
+			continue
+		}
+		repo := normalizeRepo(env.Repository)
+		for _, r := range repos {
+			if r != "" && normalizeRepo(r) == repo {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+var (
+	errHookSignature = errors.New("invalid signature")
+	errHookUnsigned  = errors.New("webhook_secret required when authentication is enabled")
+)
+
+// hookNotifs returns the notifications for a push event after checking the
+// signature against the secret of each matching project. With authentication
+// enabled, unsigned payloads are refused as anybody could send them.
+func (s *server) hookNotifs(f *forge, h http.Header, body []byte, ev *pushEvent) ([]*notif, error) {
+	ns := make([]*notif, 0)
+	conf := s.config()
+	for _, project := range conf.repoProjects(ev.repos) {
+		secret := conf.Envs[project].WebhookSecret
+		if secret == "" && conf.authEnabled() {
+			return nil, errHookUnsigned
+		}
+		if secret != "" && !f.verify(h, body, secret) {
+			return nil, errHookSignature
+		}
+		ns = append(ns, newNotif(project, ev.sha1, ev.branch, notifPush).triggered(store.BuildTriggerWebhook, ""))
+	}
+	return ns, nil
+}
+
+func (s *server) hookHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["forge"]
+	f, ok := forges[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxHookPayload))
+	if err != nil {
+		http.Error(w, "cannot read payload", http.StatusBadRequest)
+		return
+	}
+	if !f.isPush(r.Header) {
+		fmt.Fprintf(w, "Event ignored, only pushes are handled")
+		return
+	}
+	evs, err := f.parse(body)
+	if err != nil {
+		s.log.Errorf("[hooks] %s: cannot parse payload: %s", name, err)
+		http.Error(w, fmt.Sprintf("cannot parse payload: %s", err), http.StatusBadRequest)
+		return
+	}
+	notifs := make([]*notif, 0)
+	for _, ev := range evs {
+		ns, err := s.hookNotifs(f, r.Header, body, ev)
+		if err != nil {
+			s.log.Errorf("[hooks] %s: %s: %s", name, ev, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if len(ns) == 0 {
+			s.log.Printf("[hooks] %s: %s: no project configured for repository", name, ev)
+		}
+		notifs = append(notifs, ns...)
+	}
+	ids := make([]string, 0, len(notifs))
+	for _, n := range notifs {
+		id, err := s.enqueue(n)
+		if err != nil {
+			s.queueError(w, err)
+			return
+		}
+		s.log.Printf("[hooks] %s: notified %s, queued as %d", name, n, id)
+		ids = append(ids, fmt.Sprintf("%d", id))
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Scheduled %d jobs for ya! Queued as %s", len(notifs), strings.Join(ids, ", "))
+}
@@ -0,0 +1,126 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+const githubPush = `{
+  "ref": "refs/heads/feature/NEMO-123-login",
+  "before": "b72759cacd2848ce0828a2921b93cb9157948297",
+  "after": "0ff715f31f275dcdc16762ae9e80c0afbb6c1be0",
+  "deleted": false,
+  "repository": {
+    "full_name": "acme/projectNemo",
+    "clone_url": "https://github.com/acme/projectNemo.git"
+  }
+}`
+
+const gitlabDelete = `{
+  "object_kind": "push",
+  "ref": "refs/heads/feature/NEMO-123-login",
+  "after": "0000000000000000000000000000000000000000",
+  "project": {
+    "path_with_namespace": "acme/projectNemo"
+  }
+}`
+
+const bitbucketPush = `{
+  "push": {
+    "changes": [
+      {"old": null, "new": {"type": "branch", "name": "NEMO-7-new", "target": {"hash": "0ff715f31f275dcdc16762ae9e80c0afbb6c1be0"}}},
+      {"old": {"type": "branch", "name": "NEMO-8-old", "target": {"hash": "b72759cacd2848ce0828a2921b93cb9157948297"}}, "new": null},
+      {"old": null, "new": {"type": "tag", "name": "v1.0", "target": {"hash": "b72759cacd2848ce0828a2921b93cb9157948297"}}}
+    ]
+  },
+  "repository": {"full_name": "acme/projectNemo"}
+}`
+
+func TestParseGithubPush(t *testing.T) {
+	evs, err := parseGithubPush([]byte(githubPush))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 {
+		t.Fatalf("expected one event, got %d", len(evs))
+	}
+	ev := evs[0]
+	if ev.branch != "feature/NEMO-123-login" || ev.sha1 != "0ff715f31f275dcdc16762ae9e80c0afbb6c1be0" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestParseGitlabDelete(t *testing.T) {
+	evs, err := parseGitlabPush([]byte(gitlabDelete))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 1 || evs[0].sha1 != zeroSHA1 {
+		t.Fatalf("expected one deleted branch event, got %+v", evs)
+	}
+}
+
+func TestParseBitbucketPush(t *testing.T) {
+	evs, err := parseBitbucketPush([]byte(bitbucketPush))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 2 {
+		t.Fatalf("expected two branch events, got %d", len(evs))
+	}
+	if evs[0].branch != "NEMO-7-new" || evs[0].sha1 == zeroSHA1 {
+		t.Errorf("unexpected push event %+v", evs[0])
+	}
+	if evs[1].branch != "NEMO-8-old" || evs[1].sha1 != zeroSHA1 {
+		t.Errorf("unexpected delete event %+v", evs[1])
+	}
+}
+
+func TestVerifyHubSignature(t *testing.T) {
+	body := []byte(githubPush)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+	h := make(http.Header)
+	h.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	if !verifyHubSignature(h, body, "secret") {
+		t.Error("expected valid signature")
+	}
+	if verifyHubSignature(h, body, "other") {
+		t.Error("expected invalid signature with wrong secret")
+	}
+}
+
+func TestRepoProjects(t *testing.T) {
+	c := &config{Envs: map[string]envConfig{
+		"projectNemo": {Repository: "https://github.com/acme/projectNemo"},
+		"other":       {Repository: "acme/other"},
+	}}
+	names := c.repoProjects([]string{"", "https://github.com/acme/projectnemo.git"})
+	if len(names) != 1 || names[0] != "projectNemo" {
+		t.Errorf("unexpected projects %v", names)
+	}
+}
+
+func TestHookNotifsUnsigned(t *testing.T) {
+	s := &server{
+		conf: &config{Envs: map[string]envConfig{
+			"projectNemo": {Repository: "acme/projectNemo"},
+		}},
+		log: discardLogger,
+	}
+	ev := &pushEvent{repos: []string{"acme/projectNemo"}, branch: "NEMO-12-test", sha1: zeroSHA1}
+	if ns, err := s.hookNotifs(forges["github"], make(http.Header), []byte(githubPush), ev); err != nil || len(ns) != 1 {
+		t.Fatalf("expected unsigned hook to be accepted without auth, got %v", err)
+	}
+	s.conf.Auth = &authConfig{AnonymousRole: "read"}
+	if _, err := s.hookNotifs(forges["github"], make(http.Header), []byte(githubPush), ev); err != errHookUnsigned {
+		t.Errorf("expected unsigned hook to be refused with auth, got %v", err)
+	}
+}
@@ -5,11 +5,17 @@
 package umarell
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
+
+	"github.com/dullgiulio/umarell/store"
 )
 
 const reverseJenkinsURL = "{project}/jenkins/git/notifyCommit?{params}"
@@ -17,6 +23,9 @@ const reverseJenkinsURL = "{project}/jenkins/git/notifyCommit?{params}"
 func (s *server) jenkinsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
+	if !s.knownProject(w, project) {
+		return
+	}
 	url := r.URL.Query()
 
 	branches, ok := url["branches"]
@@ -27,13 +36,35 @@ func (s *server) jenkinsHandler(w http.ResponseWriter, r *http.Request) {
 	sha1 := url["sha1"]
 
 	s.log.Printf("[jenkins] project %s: branch %s: notified commit %s", project, branches[0], sha1[0])
-	s.notifs <- newNotif(project, sha1[0], branches[0], notifPush)
-	fmt.Fprintf(w, "Scheduled this %s job for ya!", project)
+	n := newNotif(project, sha1[0], branches[0], notifPush).triggered(store.BuildTriggerAPI, requestUser(r))
+	id, err := s.enqueue(n)
+	if err != nil {
+		s.queueError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Scheduled this %s job for ya! Queued as %d", project, id)
+}
+
+// Seconds clients should wait before retrying when the queue is full
+const queueRetryAfter = 30
+
+func (s *server) queueError(w http.ResponseWriter, err error) {
+	s.log.Errorf("[http] cannot queue notification: %s", err)
+	if err == errQueueFull {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", queueRetryAfter))
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
 func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	project := vars["project"]
+	if !s.knownProject(w, project) {
+		return
+	}
 	url := r.URL.Query()
 
 	branches, ok := url["branches"]
@@ -42,23 +73,386 @@ func (s *server) deleteHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.notifs <- newNotif(project, "", branches[0], notifDelete)
-	fmt.Fprintf(w, "Deletion of %s, branch %s underway", project, branches[0])
+	s.log.Printf("[http] %s: deleting %s branch %s, requested by %s", r.RemoteAddr, project, branches[0], requestUser(r))
+	n := newNotif(project, "", branches[0], notifDelete).triggered(requestTrigger(r, store.BuildTriggerManual), requestUser(r))
+	id, err := s.enqueue(n)
+	if err != nil {
+		s.queueError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(w, "Deletion of %s, branch %s underway, queued as %d", project, branches[0], id)
+}
+
+// Number of build results listed when no limit is requested
+const defaultBuildsLimit = 50
+
+type buildJSON struct {
+	ID       int64     `json:"id"`
+	Act      string    `json:"act"`
+	Status   string    `json:"status"`
+	Project  string    `json:"project"`
+	Stage    string    `json:"stage"`
+	Branch   string    `json:"branch"`
+	SHA1     string    `json:"sha1"`
+	Ticket   int64     `json:"ticket"`
+	Token    int64     `json:"token"`
+	Retval   int       `json:"retval"`
+	Queued   time.Time `json:"queued"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Wait     float64   `json:"wait_seconds"`
+	Duration float64   `json:"duration_seconds"`
+	Trigger  string    `json:"trigger"`
+	User     string    `json:"user"`
+	Cmd      string    `json:"command"`
+}
+
+func newBuildJSON(br *store.BuildResult) *buildJSON {
+	return &buildJSON{
+		ID:       br.ID,
+		Act:      br.Act.String(),
+		Status:   br.Status.String(),
+		Project:  br.Project,
+		Stage:    br.Stage,
+		Branch:   br.Branch,
+		SHA1:     br.SHA1,
+		Ticket:   br.Ticket,
+		Token:    br.Token,
+		Retval:   br.Retval,
+		Queued:   br.Queued,
+		Start:    br.Start,
+		End:      br.End,
+		Wait:     br.Wait().Seconds(),
+		Duration: br.Duration().Seconds(),
+		Trigger:  br.Trigger.String(),
+		User:     br.User,
+		Cmd:      br.Cmd,
+	}
+}
+
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid value for %s: %s", name, v)
+	}
+	return n, nil
+}
+
+func (s *server) knownProject(w http.ResponseWriter, project string) bool {
+	if _, ok := s.config().Envs[project]; !ok {
+		http.Error(w, fmt.Sprintf("project %s not configured", project), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// knownStage writes a not found error unless stage belongs to project,
+// as project tokens must not give access to the stages of other projects.
+func (s *server) knownStage(w http.ResponseWriter, project, stage string) bool {
+	if s.stageOwner(stage) != project {
+		http.Error(w, fmt.Sprintf("stage %s not found in project %s", stage, project), http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// stageOwner returns the project of a live stage or, for stages
+// that have been destroyed, the project of their last build.
+func (s *server) stageOwner(stage string) string {
+	if st, ok := s.states.get(stage); ok {
+		return st.Project
+	}
+	brs, err := s.storage.List(stage, 0, 1)
+	if err != nil || len(brs) == 0 {
+		return ""
+	}
+	return s.resultProject(brs[0])
+}
+
+// resultProject returns the project a build result belongs to.
+func (s *server) resultProject(br *store.BuildResult) string {
+	if br.Project != "" {
+		return br.Project
+	}
+	// Builds stored before the project was recorded
+	project, _ := s.stageProject(br.Stage, br.Branch)
+	return project
+}
+
+func (s *server) buildsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !s.knownProject(w, vars["project"]) || !s.knownStage(w, vars["project"], vars["stage"]) {
+		return
+	}
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit, err := queryInt(r, "limit", defaultBuildsLimit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// The token parameter authenticates requests, deployment filters by deployment token
+	deployment, err := queryInt(r, "deployment", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var brs []*store.BuildResult
+	if deployment > 0 {
+		brs, err = s.listDeployment(vars["stage"], int64(deployment), offset, limit)
+	} else {
+		brs, err = s.storage.List(vars["stage"], offset, limit)
+	}
+	if err == store.ErrNotFound {
+		brs = []*store.BuildResult{}
+	} else if err != nil {
+		s.log.Errorf("[http] cannot list builds for %s: %s", vars["stage"], err)
+		http.Error(w, "cannot list builds", http.StatusInternalServerError)
+		return
+	}
+	list := make([]*buildJSON, len(brs))
+	for i := range brs {
+		list[i] = newBuildJSON(brs[i])
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		s.log.Errorf("[http] cannot write builds: %s", err)
+	}
+}
+
+// listDeployment lists the builds of a stage run for the deployment token.
+func (s *server) listDeployment(stage string, token int64, offset, limit int) ([]*store.BuildResult, error) {
+	all, err := s.storage.List(stage, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	brs := make([]*store.BuildResult, 0)
+	for _, br := range all {
+		if br.Token == token {
+			brs = append(brs, br)
+		}
+	}
+	if offset >= len(brs) {
+		return []*store.BuildResult{}, nil
+	}
+	brs = brs[offset:]
+	if limit > 0 && limit < len(brs) {
+		brs = brs[:limit]
+	}
+	return brs, nil
+}
+
+func (s *server) buildOutputHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !s.knownProject(w, vars["project"]) {
+		return
+	}
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid build id %s", vars["id"]), http.StatusBadRequest)
+		return
+	}
+	br, err := s.storage.Result(id)
+	if err == store.ErrNotFound || (err == nil && (br.Stage != vars["stage"] || s.resultProject(br) != vars["project"])) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		s.log.Errorf("[http] cannot get build %d: %s", id, err)
+		http.Error(w, "cannot get build", http.StatusInternalServerError)
+		return
+	}
+	out := br.Stdout
+	if vars["stream"] == "stderr" {
+		out = br.Stderr
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if _, err := w.Write(out); err != nil {
+		s.log.Errorf("[http] cannot write build output: %s", err)
+	}
+}
+
+func (s *server) liveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !s.knownProject(w, vars["project"]) || !s.knownStage(w, vars["project"], vars["stage"]) {
+		return
+	}
+	live := s.lives.get(vars["stage"])
+	if live == nil {
+		http.Error(w, fmt.Sprintf("no build has run for stage %s", vars["stage"]), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	var pos int64
+	for {
+		data, next, changed, closed := live.read(pos)
+		pos = next
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if closed {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
-type urlsWriter func(host string, urls []string, w http.ResponseWriter) error
+type redeployJSON struct {
+	Project string `json:"project"`
+	Stage   string `json:"stage"`
+	// Deployment token, the build has no id until it has run
+	Token  int64  `json:"token"`
+	Live   string `json:"live_url"`
+	Builds string `json:"builds_url"`
+}
+
+// redeployHandler queues the update of a stage. The response carries the
+// deployment token of the update, not a build id as the build is stored
+// only once it has run: builds_url lists the builds of that deployment.
+
+func (s *server) redeployHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if !s.knownProject(w, vars["project"]) {
+		return
+	}
+	s.log.Printf("[http] %s: redeploying stage %s, requested by %s", r.RemoteAddr, vars["stage"], requestUser(r))
+	token, err := s.redeploy(vars["project"], vars["stage"], requestTrigger(r, store.BuildTriggerManual), requestUser(r))
+	if err == store.ErrNotFound {
+		http.Error(w, fmt.Sprintf("stage %s is not live", vars["stage"]), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Stage not redeployed: %s", err), http.StatusInternalServerError)
+		return
+	}
+	base := fmt.Sprintf("/%s/stages/%s", url.PathEscape(vars["project"]), url.PathEscape(vars["stage"]))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusAccepted)
+	err = json.NewEncoder(w).Encode(&redeployJSON{
+		Project: vars["project"],
+		Stage:   vars["stage"],
+		Token:   token,
+		Live:    base + "/live",
+		Builds:  fmt.Sprintf("%s/builds?deployment=%d", base, token),
+	})
+	if err != nil {
+		s.log.Errorf("[http] cannot write redeploy: %s", err)
+	}
+}
+
+func (s *server) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	s.log.Printf("[http] %s: reloading configuration", r.RemoteAddr)
+	if err := s.Reload(); err != nil {
+		s.log.Errorf("[http] cannot reload configuration: %s", err)
+		http.Error(w, fmt.Sprintf("Configuration not reloaded: %s", err), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "Configuration reloaded")
+}
+
+type lastBuildJSON struct {
+	ID      int64     `json:"id"`
+	Act     string    `json:"act"`
+	Status  string    `json:"status"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Trigger string    `json:"trigger"`
+	User    string    `json:"user"`
+}
+
+type stageJSON struct {
+	Project   string         `json:"project"`
+	Stage     string         `json:"stage"`
+	Branch    string         `json:"branch"`
+	Ticket    int64          `json:"ticket"`
+	SHA1      string         `json:"sha1"`
+	URL       string         `json:"url"`
+	Redeploy  string         `json:"redeploy_url"`
+	LastBuild *lastBuildJSON `json:"last_build"`
+}
+
+// stages returns all live stages with their last build.
+func (s *server) stages() []*stageJSON {
+	sts := s.states.list()
+	list := make([]*stageJSON, len(sts))
+	for i, st := range sts {
+		links := s.urls.lookup(st.Stage)
+		sj := &stageJSON{
+			Project:  st.Project,
+			Stage:    st.Stage,
+			Branch:   st.Branch,
+			Ticket:   st.Ticket,
+			SHA1:     st.SHA1,
+			URL:      links.URL,
+			Redeploy: links.Redeploy,
+		}
+		brs, err := s.storage.List(st.Stage, 0, 1)
+		if err != nil && err != store.ErrNotFound {
+			s.log.Errorf("[http] cannot get last build of %s: %s", st.Stage, err)
+		}
+		if len(brs) > 0 {
+			br := brs[0]
+			sj.LastBuild = &lastBuildJSON{
+				ID:      br.ID,
+				Act:     br.Act.String(),
+				Status:  br.Status.String(),
+				Start:   br.Start,
+				End:     br.End,
+				Trigger: br.Trigger.String(),
+				User:    br.User,
+			}
+		}
+		list[i] = sj
+	}
+	return list
+}
+
+func (s *server) jsonListHandler(w http.ResponseWriter, r *http.Request) {
+	s.log.Printf("[http] %s: serving request to list stages", r.RemoteAddr)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(s.stages()); err != nil {
+		s.log.Errorf("[http] cannot write stages: %s", err)
+	}
+}
+
+type urlsWriter func(urls []string, w http.ResponseWriter) error
 
 func (s *server) listHandler(wf urlsWriter) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		s.log.Printf("[http] %s: serving request to read jenkins URLs", r.RemoteAddr)
-		urls := s.urls.get()
-		sort.Strings(urls)
+		s.log.Printf("[http] %s: serving request to read stage URLs", r.RemoteAddr)
 		host := r.Host
 		if host == "" {
 			host = "localhost"
 		}
-		if err := wf(host, urls, w); err != nil {
-			s.log.Printf("[http] cannot write URLs: %s", err)
+		// Stages without a configured URL are listed with their redeploy link
+		links := s.urls.get()
+		urls := make([]string, len(links))
+		for i, l := range links {
+			urls[i] = l.URL
+			if urls[i] == "" {
+				urls[i] = fmt.Sprintf("http://%s/%s", host, l.Redeploy)
+			}
+		}
+		sort.Strings(urls)
+		if err := wf(urls, w); err != nil {
+			s.log.Errorf("[http] cannot write URLs: %s", err)
 			return
 		}
 		if f, ok := w.(http.Flusher); ok {
@@ -67,32 +461,36 @@ func (s *server) listHandler(wf urlsWriter) func(http.ResponseWriter, *http.Requ
 	}
 }
 
-func textWriter(host string, urls []string, w http.ResponseWriter) error {
+func textWriter(urls []string, w http.ResponseWriter) error {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	for _, url := range urls {
-		if _, err := fmt.Fprintf(w, "http://%s/%s\n", host, url); err != nil {
+		if _, err := fmt.Fprintf(w, "%s\n", url); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func htmlWriter(host string, urls []string, w http.ResponseWriter) error {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	for _, url := range urls {
-		link := fmt.Sprintf("http://%s/%s\n", host, url)
-		if _, err := fmt.Fprintf(w, "<a href=\"%s\">%s</a><br />\n", link, link); err != nil {
-			return err
-		}
-	}
-	return nil
+func (s *server) ServeHTTP(listen string) {
+	s.log.Fatal(http.ListenAndServe(listen, s.router()))
 }
 
-func (s *server) ServeHTTP(listen string) {
+func (s *server) router() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/_/text", s.listHandler(textWriter))
-	r.HandleFunc("/_/html", s.listHandler(htmlWriter))
-	r.HandleFunc("/{project}/delete", s.deleteHandler)
-	r.HandleFunc("/{project}/jenkins/git/notifyCommit", s.jenkinsHandler)
-	s.log.Fatal(http.ListenAndServe(listen, r))
+	r.HandleFunc("/_/text", s.authorize(roleRead, s.listHandler(textWriter)))
+	r.HandleFunc("/", s.authorize(roleRead, s.dashboardHandler)).Methods("GET")
+	r.HandleFunc("/_/html", s.authorize(roleRead, s.dashboardHandler)).Methods("GET")
+	r.HandleFunc("/_/json", s.authorize(roleRead, s.jsonListHandler)).Methods("GET")
+	// Webhooks are authenticated by their signature, required if auth is enabled
+	r.HandleFunc("/_/hooks/{forge}", s.hookHandler).Methods("POST")
+	r.HandleFunc("/_/reload", s.authorize(roleAdmin, s.reloadHandler)).Methods("POST")
+	r.HandleFunc("/metrics", s.authorize(roleRead, s.metricsHandler)).Methods("GET")
+	// Browsers resend basic auth credentials, a GET could be forged by any page
+	r.HandleFunc("/{project}/delete", s.authorize(roleAdmin, s.deleteHandler)).Methods("POST")
+	r.HandleFunc("/{project}/stages/{stage}/builds", s.authorize(roleRead, s.buildsHandler)).Methods("GET")
+	r.HandleFunc("/{project}/stages/{stage}/live", s.authorize(roleRead, s.liveHandler)).Methods("GET")
+	r.HandleFunc("/{project}/stages/{stage}/redeploy", s.authorize(roleDeploy, s.redeployHandler)).Methods("POST")
+	r.HandleFunc("/{project}/stages/{stage}/builds/{id:[0-9]+}/{stream:stdout|stderr}", s.authorize(roleRead, s.buildOutputHandler)).Methods("GET")
+	r.HandleFunc("/{project}/jenkins/git/notifyCommit", s.authorize(roleDeploy, s.jenkinsHandler))
+	return r
 }
@@ -0,0 +1,241 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+	"github.com/gorilla/mux"
+)
+
+func TestJSONList(t *testing.T) {
+	s := &server{
+		storage: store.NewMemory(),
+		states:  newStageStates(nil, discardLogger),
+		urls:    newUrls(),
+		log:     discardLogger,
+	}
+	s.states.set(&stageState{Project: "projectNemo", Stage: "projectNemo.ticket13", Branch: "NEMO-13-test", Ticket: 13})
+	s.states.set(&stageState{Project: "projectNemo", Stage: "projectNemo.ticket12", Branch: "NEMO-12-test", Ticket: 12, SHA1: "0ff715f"})
+	s.urls.set("projectNemo.ticket12", stageURLs{URL: "https://nemo12.example.test/"})
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	s.storage.Add(&store.BuildResult{Stage: "projectNemo.ticket12", Act: store.BuildActCreate, Start: start, End: start.Add(time.Minute)})
+	s.storage.Add(&store.BuildResult{Stage: "projectNemo.ticket12", Act: store.BuildActUpdate, Retval: 2, Status: store.BuildStatusFailed, Start: start.Add(time.Hour), End: start.Add(time.Hour)})
+
+	w := httptest.NewRecorder()
+	s.jsonListHandler(w, httptest.NewRequest("GET", "/_/json", nil))
+	var list []*stageJSON
+	if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("expected two stages, got %d", len(list))
+	}
+	nemo12 := list[0]
+	if nemo12.Stage != "projectNemo.ticket12" || nemo12.Ticket != 12 || nemo12.SHA1 != "0ff715f" || nemo12.URL != "https://nemo12.example.test/" {
+		t.Errorf("unexpected stage %+v", nemo12)
+	}
+	if lb := nemo12.LastBuild; lb == nil || lb.ID != 2 || lb.Act != "update" || lb.Status != "failed" {
+		t.Errorf("unexpected last build %+v", lb)
+	}
+	if list[1].LastBuild != nil {
+		t.Errorf("expected no build for %s", list[1].Stage)
+	}
+}
+
+func TestJenkinsUnknownProject(t *testing.T) {
+	q, err := newNotifQueue(10, "", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		conf: &config{
+			Envs: map[string]envConfig{"projectNemo": {}},
+		},
+		queue: q,
+		log:   discardLogger,
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/{project}/jenkins/git/notifyCommit", s.jenkinsHandler)
+
+	for _, tt := range []struct {
+		project string
+		status  int
+	}{
+		{"projectDory", http.StatusNotFound},
+		{"projectNemo", http.StatusAccepted},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/"+tt.project+"/jenkins/git/notifyCommit?branches=NEMO-12-test&sha1=0ff715f", nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.project, tt.status, w.Code)
+		}
+	}
+	if len(q.ch) != 1 {
+		t.Fatalf("expected only the configured project queued, got %d notifications", len(q.ch))
+	}
+	if n := <-q.ch; n.project != "projectNemo" {
+		t.Errorf("unexpected notification for %s", n.project)
+	}
+}
+
+// newBuildsServer returns a server with three builds of projectNemo.ticket12,
+// one stored before projects were recorded and a live stage of projectDory.
+func newBuildsServer() *server {
+	s := &server{
+		conf: &config{
+			regexBranch: regexp.MustCompile(`^(?:[A-Z0-9]+\-)?(\d+)\-`),
+			Envs: map[string]envConfig{
+				"projectNemo": {Branches: map[string][]string{"__default__": {"{ENV}.ticket{TICKET}"}}},
+				"projectDory": {Branches: map[string][]string{"__default__": {"{ENV}.ticket{TICKET}"}}},
+			},
+		},
+		storage: store.NewMemory(),
+		states:  newStageStates(nil, discardLogger),
+		log:     discardLogger,
+	}
+	start := time.Date(2016, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		s.storage.Add(&store.BuildResult{
+			Project: "projectNemo",
+			Stage:   "projectNemo.ticket12",
+			Token:   int64(i + 1),
+			Act:     store.BuildActUpdate,
+			Start:   start.Add(time.Duration(i) * time.Hour),
+			End:     start.Add(time.Duration(i) * time.Hour),
+			Stdout:  []byte(fmt.Sprintf("update %d\n", i+1)),
+			Stderr:  []byte(fmt.Sprintf("warning %d\n", i+1)),
+		})
+	}
+	s.storage.Add(&store.BuildResult{Stage: "projectNemo.ticket13", Branch: "NEMO-13-test", Act: store.BuildActCreate, Start: start, End: start})
+	s.storage.Add(&store.BuildResult{Project: "projectDory", Stage: "projectDory.ticket1", Act: store.BuildActCreate, Start: start, End: start, Stdout: []byte("dory\n")})
+	s.states.set(&stageState{Project: "projectDory", Stage: "projectDory.ticket1", Branch: "DORY-1-test", Ticket: 1})
+	return s
+}
+
+// buildsRouter serves the builds handlers of s, wrapped by wrap.
+func buildsRouter(s *server, wrap func(http.HandlerFunc) http.HandlerFunc) *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/{project}/stages/{stage}/builds", wrap(s.buildsHandler))
+	r.HandleFunc("/{project}/stages/{stage}/builds/{id:[0-9]+}/{stream:stdout|stderr}", wrap(s.buildOutputHandler))
+	r.HandleFunc("/{project}/stages/{stage}/live", wrap(s.liveHandler))
+	return r
+}
+
+func noWrap(h http.HandlerFunc) http.HandlerFunc {
+	return h
+}
+
+func TestBuildsHandler(t *testing.T) {
+	r := buildsRouter(newBuildsServer(), noWrap)
+	tests := []struct {
+		path   string
+		status int
+		ids    []int64
+	}{
+		{"/projectNemo/stages/projectNemo.ticket12/builds", http.StatusOK, []int64{3, 2, 1}},
+		{"/projectNemo/stages/projectNemo.ticket12/builds?offset=1&limit=1", http.StatusOK, []int64{2}},
+		{"/projectNemo/stages/projectNemo.ticket12/builds?offset=3", http.StatusOK, []int64{}},
+		{"/projectNemo/stages/projectNemo.ticket12/builds?deployment=2", http.StatusOK, []int64{2}},
+		{"/projectNemo/stages/projectNemo.ticket12/builds?deployment=2&offset=1", http.StatusOK, []int64{}},
+		{"/projectNemo/stages/projectNemo.ticket13/builds", http.StatusOK, []int64{4}},
+		{"/projectNemo/stages/projectNemo.ticket14/builds", http.StatusNotFound, nil},
+		{"/projectNemo/stages/projectDory.ticket1/builds", http.StatusNotFound, nil},
+		{"/projectNemo/stages/projectNemo.ticket12/builds?limit=-1", http.StatusBadRequest, nil},
+		{"/projectShark/stages/projectShark.ticket12/builds", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+			continue
+		}
+		if tt.ids == nil {
+			continue
+		}
+		var list []*buildJSON
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatalf("%s: %s", tt.path, err)
+		}
+		if len(list) != len(tt.ids) {
+			t.Errorf("%s: expected %d builds, got %d", tt.path, len(tt.ids), len(list))
+			continue
+		}
+		for i, id := range tt.ids {
+			if list[i].ID != id {
+				t.Errorf("%s: expected build %d at %d, got %d", tt.path, id, i, list[i].ID)
+			}
+		}
+	}
+}
+
+func TestBuildOutputHandler(t *testing.T) {
+	r := buildsRouter(newBuildsServer(), noWrap)
+	tests := []struct {
+		path   string
+		status int
+		out    string
+	}{
+		{"/projectNemo/stages/projectNemo.ticket12/builds/2/stdout", http.StatusOK, "update 2\n"},
+		{"/projectNemo/stages/projectNemo.ticket12/builds/2/stderr", http.StatusOK, "warning 2\n"},
+		// Build 4 belongs to another stage
+		{"/projectNemo/stages/projectNemo.ticket12/builds/4/stdout", http.StatusNotFound, ""},
+		{"/projectNemo/stages/projectNemo.ticket12/builds/99/stdout", http.StatusNotFound, ""},
+		{"/projectDory/stages/projectNemo.ticket12/builds/2/stdout", http.StatusNotFound, ""},
+		{"/projectNemo/stages/projectDory.ticket1/builds/5/stdout", http.StatusNotFound, ""},
+		{"/projectDory/stages/projectDory.ticket1/builds/5/stdout", http.StatusOK, "dory\n"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, w.Code)
+			continue
+		}
+		if tt.status == http.StatusOK && w.Body.String() != tt.out {
+			t.Errorf("%s: unexpected output %q", tt.path, w.Body.String())
+		}
+	}
+}
+
+func TestDeleteMethod(t *testing.T) {
+	q, err := newNotifQueue(10, "", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{
+		conf: &config{
+			Envs: map[string]envConfig{"projectNemo": {}},
+		},
+		queue: q,
+		log:   discardLogger,
+	}
+	r := s.router()
+	for _, tt := range []struct {
+		method string
+		status int
+	}{
+		// The vendored router answers not found to other methods
+		{"GET", http.StatusNotFound},
+		{"POST", http.StatusAccepted},
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(tt.method, "/projectNemo/delete?branches=NEMO-12-test", nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.method, tt.status, w.Code)
+		}
+	}
+	if len(q.ch) != 1 {
+		t.Errorf("expected only the POST queued, got %d notifications", len(q.ch))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"sync"
+)
+
+// Bytes of output kept for each running build
+const liveBufferSize = 64 * 1024
+
+// liveLog is a ring buffer holding the latest output of a running command.
+// Readers can follow the output by waiting on the channel returned by read.
+type liveLog struct {
+	mux     sync.Mutex
+	buf     []byte
+	written int64 // total bytes ever written
+	closed  bool
+	changed chan struct{}
+}
+
+func newLiveLog(size int) *liveLog {
+	return &liveLog{
+		buf:     make([]byte, size),
+		changed: make(chan struct{}),
+	}
+}
+
+func (l *liveLog) Write(p []byte) (int, error) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	n := len(p)
+	size := len(l.buf)
+	// Only the tail of a very large write can fit
+	if len(p) > size {
+		l.written += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	pos := int(l.written % int64(size))
+	c := copy(l.buf[pos:], p)
+	copy(l.buf, p[c:])
+	l.written += int64(len(p))
+	l.notify()
+	return n, nil
+}
+
+// notify wakes up all readers; must be called with the lock held.
+func (l *liveLog) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *liveLog) close() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.closed = true
+	l.notify()
+}
+
+// read returns the output written since offset pos, the offset to use for
+// the next read and a channel that is closed when more output is available.
+// If pos is too old, reading starts from the oldest byte still buffered.
+// When closed is true, no more output will be written.
+func (l *liveLog) read(pos int64) (data []byte, next int64, changed <-chan struct{}, closed bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	size := int64(len(l.buf))
+	if oldest := l.written - size; pos < oldest {
+		pos = oldest
+	}
+	if pos < 0 {
+		pos = 0
+	}
+	data = make([]byte, l.written-pos)
+	start := int(pos % size)
+	c := copy(data, l.buf[start:])
+	copy(data[c:], l.buf)
+	return data, l.written, l.changed, l.closed
+}
+
+type liveLogs struct {
+	entries map[string]*liveLog // stage : output of last build
+	mux     sync.RWMutex
+}
+
+func newLiveLogs() *liveLogs {
+	return &liveLogs{
+		entries: make(map[string]*liveLog),
+	}
+}
+
+func (l *liveLogs) get(stage string) *liveLog {
+	l.mux.RLock()
+	defer l.mux.RUnlock()
+
+	return l.entries[stage]
+}
+
+func (l *liveLogs) set(stage string, ll *liveLog) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	l.entries[stage] = ll
+}
+
+func (l *liveLogs) del(stage string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	delete(l.entries, stage)
+}
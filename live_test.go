@@ -0,0 +1,49 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"testing"
+)
+
+func TestLiveLogRing(t *testing.T) {
+	l := newLiveLog(8)
+	l.Write([]byte("hello "))
+	data, pos, _, closed := l.read(0)
+	if string(data) != "hello " || pos != 6 || closed {
+		t.Errorf("unexpected first read: %q %d %v", data, pos, closed)
+	}
+	l.Write([]byte("world"))
+	data, pos, _, _ = l.read(pos)
+	if string(data) != "world" || pos != 11 {
+		t.Errorf("unexpected second read: %q %d", data, pos)
+	}
+	// Reading from the start only returns what is still buffered
+	data, _, _, _ = l.read(0)
+	if string(data) != "lo world" {
+		t.Errorf("unexpected wrapped read: %q", data)
+	}
+	l.Write([]byte("0123456789"))
+	data, _, _, _ = l.read(0)
+	if string(data) != "23456789" {
+		t.Errorf("unexpected read after large write: %q", data)
+	}
+}
+
+func TestLiveLogNotify(t *testing.T) {
+	l := newLiveLog(8)
+	_, pos, changed, _ := l.read(0)
+	go l.Write([]byte("x"))
+	<-changed
+	data, _, changed, _ := l.read(pos)
+	if string(data) != "x" {
+		t.Errorf("unexpected read after notification: %q", data)
+	}
+	go l.close()
+	<-changed
+	if _, _, _, closed := l.read(pos); !closed {
+		t.Error("expected log to be closed")
+	}
+}
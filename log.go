@@ -5,15 +5,158 @@
 package umarell
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"strconv"
+	"strings"
 )
 
+// logger writes leveled messages. Messages can start with a "[component]"
+// prefix, that structured formats report as a separate field. Fields added
+// with "with" are written with every message.
 type logger interface {
+	Debugf(string, ...interface{})
 	Printf(string, ...interface{})
+	Errorf(string, ...interface{})
 	Fatal(...interface{})
+	with(keyvals ...interface{}) logger
+}
+
+var logLevels = map[string]slog.Level{
+	"":      slog.LevelInfo,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"error": slog.LevelError,
 }
 
 func newStdLogger() logger {
-	return log.New(os.Stderr, "", log.LstdFlags)
+	return newTextLogger(os.Stderr, slog.LevelInfo)
+}
+
+// newLogger returns a logger writing in text (the default), logfmt or JSON format.
+func newLogger(w io.Writer, format, level string) (logger, error) {
+	lvl, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %s", level)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "", "text":
+		return newTextLogger(w, lvl), nil
+	case "logfmt":
+		return &structLogger{l: slog.New(slog.NewTextHandler(w, opts))}, nil
+	case "json":
+		return &structLogger{l: slog.New(slog.NewJSONHandler(w, opts))}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %s", format)
+}
+
+// splitComponent separates the "[component]" prefix from a message.
+func splitComponent(msg string) (string, string) {
+	if len(msg) == 0 || msg[0] != '[' {
+		return "", msg
+	}
+	end := strings.IndexByte(msg, ']')
+	if end < 0 {
+		return "", msg
+	}
+	return msg[1:end], strings.TrimLeft(msg[end+1:], " ")
+}
+
+// textLogger writes human readable lines with the fields appended as key=value.
+type textLogger struct {
+	l      *log.Logger
+	level  slog.Level
+	fields string
+}
+
+func newTextLogger(w io.Writer, level slog.Level) *textLogger {
+	return &textLogger{
+		l:     log.New(w, "", log.LstdFlags),
+		level: level,
+	}
+}
+
+func (t *textLogger) logf(level slog.Level, format string, args ...interface{}) {
+	if level < t.level {
+		return
+	}
+	var prefix string
+	if level >= slog.LevelError {
+		prefix = "[error] "
+	}
+	t.l.Printf("%s%s%s", prefix, fmt.Sprintf(format, args...), t.fields)
+}
+
+func (t *textLogger) Debugf(format string, args ...interface{}) {
+	t.logf(slog.LevelDebug, format, args...)
+}
+
+func (t *textLogger) Printf(format string, args ...interface{}) {
+	t.logf(slog.LevelInfo, format, args...)
+}
+
+func (t *textLogger) Errorf(format string, args ...interface{}) {
+	t.logf(slog.LevelError, format, args...)
+}
+
+func (t *textLogger) Fatal(args ...interface{}) {
+	t.l.Fatal(append(args, t.fields)...)
+}
+
+func (t *textLogger) with(keyvals ...interface{}) logger {
+	var buf bytes.Buffer
+	buf.WriteString(t.fields)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		val := fmt.Sprintf("%v", keyvals[i+1])
+		if val == "" || strings.ContainsAny(val, " \t\"=") {
+			val = strconv.Quote(val)
+		}
+		fmt.Fprintf(&buf, " %v=%s", keyvals[i], val)
+	}
+	return &textLogger{l: t.l, level: t.level, fields: buf.String()}
+}
+
+// structLogger writes logfmt or JSON records through slog.
+type structLogger struct {
+	l *slog.Logger
+}
+
+func (s *structLogger) logf(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if !s.l.Enabled(ctx, level) {
+		return
+	}
+	component, msg := splitComponent(fmt.Sprintf(format, args...))
+	if component == "" {
+		s.l.Log(ctx, level, msg)
+		return
+	}
+	s.l.Log(ctx, level, msg, "component", component)
+}
+
+func (s *structLogger) Debugf(format string, args ...interface{}) {
+	s.logf(slog.LevelDebug, format, args...)
+}
+
+func (s *structLogger) Printf(format string, args ...interface{}) {
+	s.logf(slog.LevelInfo, format, args...)
+}
+
+func (s *structLogger) Errorf(format string, args ...interface{}) {
+	s.logf(slog.LevelError, format, args...)
+}
+
+func (s *structLogger) Fatal(args ...interface{}) {
+	s.l.Error(fmt.Sprint(args...))
+	os.Exit(1)
+}
+
+func (s *structLogger) with(keyvals ...interface{}) logger {
+	return &structLogger{l: s.l.With(keyvals...)}
 }
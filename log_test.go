@@ -0,0 +1,55 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestTextLoggerFields(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "text", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l = l.with("project", "projectNemo", "branch", "NEMO-12 test")
+	l.Debugf("[build] hidden")
+	l.Errorf("[build] failed")
+	out := buf.String()
+	if strings.Contains(out, "hidden") {
+		t.Errorf("debug message written at info level: %s", out)
+	}
+	if !strings.Contains(out, `[error] [build] failed project=projectNemo branch="NEMO-12 test"`) {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+func TestJSONLoggerComponent(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.with("stage", "projectNemo.ticket12").Debugf("[build] running %s", "create")
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec["component"] != "build" || rec["msg"] != "running create" || rec["stage"] != "projectNemo.ticket12" || rec["level"] != "DEBUG" {
+		t.Errorf("unexpected record: %v", rec)
+	}
+}
+
+func TestNewLoggerInvalid(t *testing.T) {
+	if _, err := newLogger(&bytes.Buffer{}, "xml", ""); err == nil {
+		t.Error("expected error for unknown format")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, "", "verbose"); err == nil {
+		t.Error("expected error for unknown level")
+	}
+}
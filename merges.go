@@ -6,6 +6,10 @@ package umarell
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
 )
 
 type buildver struct {
@@ -18,6 +22,8 @@ type mergereq struct {
 	notif *notif
 	build *build
 	token int64
+	// Only restore the last known revision, do not check for merges
+	restore bool
 }
 
 func newMergereq(notif *notif, token int64, build *build) *mergereq {
@@ -43,13 +49,17 @@ func newCheckout(stage, dir string, ver buildver) *checkout {
 }
 
 type mergebot struct {
-	project   string
+	project string
+	// Protects norem and checkouts, that can be added while running
+	mux       sync.Mutex
 	norem     map[string]struct{}  // stages that cannot be removed
 	checkouts map[string]*checkout // stage : checkout
 	vers      map[string]*buildver // stage : version
 	reqs      chan *mergereq
 	dels      chan string // stage
+	quit      chan struct{}
 	srv       *server
+	log       logger
 }
 
 func newMergebot(project string, s *server) *mergebot {
@@ -61,21 +71,29 @@ func newMergebot(project string, s *server) *mergebot {
 		vers:      make(map[string]*buildver),
 		reqs:      make(chan *mergereq),
 		dels:      make(chan string),
+		quit:      make(chan struct{}),
+		log:       s.log.with("project", project),
 	}
 	return b
 }
 
 func (b *mergebot) addUnremovable(stage string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
 	b.norem[stage] = struct{}{}
 }
 
 func (b *mergebot) addCheckout(dir string, notif *notif, build *build) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
 	bv := buildver{
 		sha1:  notif.sha1,
 		build: build,
 	}
 	b.checkouts[build.stage] = newCheckout(build.stage, dir, bv)
-	b.srv.log.Printf("[mergebot] %s: init %s to %s using stage %s", b.project, notif.branch, notif.sha1, build.stage)
+	b.log.with("stage", build.stage, "branch", notif.branch, "sha1", notif.sha1).Printf("[mergebot] init checkout")
 }
 
 func (b *mergebot) registerBuild(req *mergereq) {
@@ -87,15 +105,16 @@ func (b *mergebot) registerBuild(req *mergereq) {
 	}
 	bv.sha1 = req.notif.sha1
 	b.vers[req.build.stage] = bv
-	b.srv.log.Printf("[mergebot] %s: set latest revision to %s stage %s", b.project, req.notif.sha1, req.build.stage)
+	b.log.with("stage", req.build.stage, "sha1", req.notif.sha1, "token", req.token).Printf("[mergebot] set latest revision")
 }
 
 func (b *mergebot) checkMerged(notif *notif, token int64, co *checkout, pjs *projects) error {
 	ver := co.ver
-	b.srv.log.Printf("[mergebot] %s: checking that %s from %s has been merged to %s", b.project, ver.sha1, ver.build.stage, co.stage)
+	b.log.with("stage", co.stage, "sha1", ver.sha1).Printf("[mergebot] checking merges since the latest revision")
+	b.srv.metrics.mergeChecks.inc(b.project)
 	commits := newGitcommits()
 	if ver.sha1 == "" {
-		return fmt.Errorf("cannot fetch commits since last build, last SHA1 is empty", b.project)
+		return fmt.Errorf("%s: cannot fetch commits since last build, last SHA1 is empty", b.project)
 	}
 	if err := commits.since(ver.sha1, co.dir); err != nil {
 		return fmt.Errorf("%s: can't fetch commits since %s: %s", co.dir, ver.sha1, err)
@@ -104,16 +123,19 @@ func (b *mergebot) checkMerged(notif *notif, token int64, co *checkout, pjs *pro
 	for k, bv := range b.vers {
 		// Do not attempt to remove a checked-out stage.
 		if _, ok := b.norem[bv.build.stage]; ok {
-			b.srv.log.Printf("[mergebot] %s: merge to %s ignored", b.project, bv.build.stage)
+			b.log.with("stage", bv.build.stage).Debugf("[mergebot] merge ignored")
 			continue
 		}
 		if commits.contains(githash(bv.sha1)) {
-			b.srv.log.Printf("[mergebot] %s: can remove env %s, it was merged", b.project, bv.build.stage)
+			b.log.with("stage", bv.build.stage, "sha1", bv.sha1, "token", token).Printf("[mergebot] can remove env, it was merged")
 			b.srv.urls.del(bv.build.stage)
 			// As we have been called by pjs, to make a request we need to wait for the current one to finish.
 			// To avoid a deadlock, we must notify of the merge in the background.
-			go pjs.destroy(bv.build, notif, token)
+			mn := notif.triggered(store.BuildTriggerMerge, "")
+			mn.id, mn.queued = 0, time.Now()
+			go pjs.destroy(bv.build, mn, token, nil)
 			merged = append(merged, k)
+			b.srv.metrics.mergeDestroys.inc(b.project)
 		}
 	}
 	for _, k := range merged {
@@ -122,12 +144,23 @@ func (b *mergebot) checkMerged(notif *notif, token int64, co *checkout, pjs *pro
 	return nil
 }
 
+// Requests to a stopped mergebot are discarded.
 func (b *mergebot) destroy(stage string) {
-	b.dels <- stage
+	select {
+	case b.dels <- stage:
+	case <-b.quit:
+	}
 }
 
 func (b *mergebot) send(req *mergereq) {
-	b.reqs <- req
+	select {
+	case b.reqs <- req:
+	case <-b.quit:
+	}
+}
+
+func (b *mergebot) stop() {
+	close(b.quit)
 }
 
 func (b *mergebot) run(pjs *projects) {
@@ -137,12 +170,25 @@ func (b *mergebot) run(pjs *projects) {
 			b.doReq(req, pjs)
 		case stage := <-b.dels:
 			delete(b.vers, stage)
+		case <-b.quit:
+			b.log.Printf("[mergebot] stopped")
+			return
 		}
 	}
 }
 
 func (b *mergebot) doReq(req *mergereq, pjs *projects) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
 	co, hasCheckout := b.checkouts[req.build.stage]
+	log := b.log.with("stage", req.build.stage, "sha1", req.notif.sha1, "token", req.token)
+	if hasCheckout && req.restore {
+		// Merges that happened while we were down are detected at the next push
+		co.ver.sha1 = req.notif.sha1
+		log.Printf("[mergebot] restored revision")
+		return
+	}
 	if !hasCheckout {
 		// normally update some tracked version
 		b.registerBuild(req)
@@ -150,10 +196,10 @@ func (b *mergebot) doReq(req *mergereq, pjs *projects) {
 	}
 	// It's a push to a checked out stage, trigger the delete etc
 	if err := b.checkMerged(req.notif, req.token, co, pjs); err != nil {
-		b.srv.log.Printf("[mergebot] %s: failed merge check: %s", b.project, err)
+		log.Errorf("[mergebot] failed merge check: %s", err)
 	}
 	co.ver.sha1 = req.notif.sha1
-	b.srv.log.Printf("[mergebot] %s: merge check done, set latest revision to %s stage %s", b.project, req.notif.sha1, co.ver.build.stage)
+	log.Printf("[mergebot] merge check done, set latest revision")
 }
 
 type mergebots map[string]*mergebot // project : mergebots
@@ -171,3 +217,10 @@ func (m mergebots) create(project string, s *server) *mergebot {
 	m[project] = b
 	return b
 }
+
+func (m mergebots) remove(project string) {
+	if b, ok := m[project]; ok {
+		b.stop()
+		delete(m, project)
+	}
+}
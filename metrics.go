@@ -0,0 +1,234 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Upper bounds in seconds of the command duration histogram buckets
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelSet renders label names and values as {name="value",...}.
+func labelSet(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, names[i], labelEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// counterVec is a set of counters with the same name, one for each set of label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mux    sync.Mutex
+	vals   map[string]float64 // rendered labels : value
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		vals:   make(map[string]float64),
+	}
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	c.vals[labelSet(c.labels, values)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.vals))
+	for k := range c.vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatFloat(c.vals[k]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // non cumulative count for each bucket
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a set of histograms, one for each label value.
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	mux     sync.Mutex
+	vals    map[string]*histogram // label value : histogram
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		vals:    make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(value string, v float64) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	hs, ok := h.vals[value]
+	if !ok {
+		hs = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.vals[value] = hs
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hs.counts[i]++
+			break
+		}
+	}
+	hs.sum += v
+	hs.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+	values := make([]string, 0, len(h.vals))
+	for v := range h.vals {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		hs := h.vals[v]
+		lv := labelEscaper.Replace(v)
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += hs.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"%s\"} %d\n", h.name, h.label, lv, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=\"%s\",le=\"+Inf\"} %d\n", h.name, h.label, lv, hs.count)
+		fmt.Fprintf(w, "%s_sum{%s=\"%s\"} %s\n", h.name, h.label, lv, formatFloat(hs.sum))
+		fmt.Fprintf(w, "%s_count{%s=\"%s\"} %d\n", h.name, h.label, lv, hs.count)
+	}
+}
+
+// metrics collects the counters exposed in the Prometheus text format.
+type metrics struct {
+	notifs        *counterVec
+	buildsStarted *counterVec
+	buildsDone    *counterVec
+	buildsFailed  *counterVec
+	buildsSkipped *counterVec
+	// Cancelled builds are not counted as failed
+	buildsCancelled *counterVec
+	durations       *histogramVec
+	mergeChecks     *counterVec
+	mergeDestroys   *counterVec
+	// Protects stages, that is replaced by the projects loop
+	mux    sync.Mutex
+	stages map[string]int // project : live stages
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		notifs:          newCounterVec("umarell_notifications_total", "Notifications received.", "project", "type"),
+		buildsStarted:   newCounterVec("umarell_builds_started_total", "Build commands started.", "act"),
+		buildsDone:      newCounterVec("umarell_builds_finished_total", "Build commands finished, successfully or not.", "act"),
+		buildsFailed:    newCounterVec("umarell_builds_failed_total", "Build commands that failed or timed out.", "act"),
+		buildsSkipped:   newCounterVec("umarell_builds_skipped_total", "Build requests superseded by a newer one before running.", "act"),
+		buildsCancelled: newCounterVec("umarell_builds_cancelled_total", "Build commands cancelled by a newer request.", "act"),
+		durations:       newHistogramVec("umarell_build_duration_seconds", "Duration of build commands.", "act", durationBuckets),
+		mergeChecks:     newCounterVec("umarell_mergebot_checks_total", "Checks for merged branches performed by the merge detector.", "project"),
+		mergeDestroys:   newCounterVec("umarell_mergebot_destroys_total", "Stages destroyed because their branch was merged.", "project"),
+		stages:          make(map[string]int),
+	}
+}
+
+func (m *metrics) setStages(stages map[string]int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	m.stages = stages
+}
+
+func (m *metrics) writeStages(w io.Writer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	writeHeader(w, "umarell_live_stages", "Stages currently tracked.", "gauge")
+	projects := make([]string, 0, len(m.stages))
+	for p := range m.stages {
+		projects = append(projects, p)
+	}
+	sort.Strings(projects)
+	for _, p := range projects {
+		fmt.Fprintf(w, "umarell_live_stages%s %d\n", labelSet([]string{"project"}, []string{p}), m.stages[p])
+	}
+}
+
+func (s *server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	m.notifs.write(w)
+	m.buildsStarted.write(w)
+	m.buildsDone.write(w)
+	m.buildsFailed.write(w)
+	m.buildsSkipped.write(w)
+	m.buildsCancelled.write(w)
+	m.durations.write(w)
+	m.mergeChecks.write(w)
+	m.mergeDestroys.write(w)
+	m.writeStages(w)
+	// Without a limit there are no slots to report
+	if s.limitBuilds != nil {
+		writeHeader(w, "umarell_build_slots_free", "Builds that can be started before reaching limit_builds.", "gauge")
+		fmt.Fprintf(w, "umarell_build_slots_free %d\n", len(s.limitBuilds))
+		writeHeader(w, "umarell_build_slots", "Maximum number of concurrent builds.", "gauge")
+		fmt.Fprintf(w, "umarell_build_slots %d\n", cap(s.limitBuilds))
+	}
+}
+
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	s.writeMetrics(bw)
+	if err := bw.Flush(); err != nil {
+		s.log.Errorf("[http] cannot write metrics: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	s := &server{metrics: newMetrics(), limitBuilds: make(chan struct{}, 2)}
+	s.limitBuilds <- struct{}{}
+	m := s.metrics
+	m.notifs.inc("projectNemo", "push")
+	m.notifs.inc("projectNemo", "push")
+	m.notifs.inc(`quoted"project`, "delete")
+	m.durations.observe("create", 3)
+	m.durations.observe("create", 45)
+	m.durations.observe("create", 7200)
+	m.setStages(map[string]int{"projectNemo": 2})
+
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE umarell_notifications_total counter",
+		`umarell_notifications_total{project="projectNemo",type="push"} 2`,
+		`umarell_notifications_total{project="quoted\"project",type="delete"} 1`,
+		"# TYPE umarell_build_duration_seconds histogram",
+		`umarell_build_duration_seconds_bucket{act="create",le="1"} 0`,
+		`umarell_build_duration_seconds_bucket{act="create",le="5"} 1`,
+		`umarell_build_duration_seconds_bucket{act="create",le="60"} 2`,
+		`umarell_build_duration_seconds_bucket{act="create",le="3600"} 2`,
+		`umarell_build_duration_seconds_bucket{act="create",le="+Inf"} 3`,
+		`umarell_build_duration_seconds_sum{act="create"} 7248`,
+		`umarell_build_duration_seconds_count{act="create"} 3`,
+		`umarell_live_stages{project="projectNemo"} 2`,
+		"umarell_build_slots_free 1",
+		"umarell_build_slots 2",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in output:\n%s", line, out)
+		}
+	}
+}
+
+func TestNotifMetricsUnknownProject(t *testing.T) {
+	s := &server{
+		conf: &config{
+			Envs: map[string]envConfig{"projectNemo": {}},
+		},
+		metrics: newMetrics(),
+		log:     discardLogger,
+	}
+	for _, project := range []string{"projectDory", "projectShark"} {
+		if bs, _ := s.notifBuilds(newNotif(project, "0ff715f", "NEMO-12-test", notifPush), makeMergebots()); bs != nil {
+			t.Fatalf("unexpected builds for %s", project)
+		}
+	}
+	var buf bytes.Buffer
+	s.writeMetrics(&buf)
+	if out := buf.String(); !strings.Contains(out, `umarell_notifications_total{project="unknown",type="push"} 2`) || strings.Contains(out, "projectDory") {
+		t.Errorf("unexpected metrics:\n%s", out)
+	}
+}
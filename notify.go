@@ -0,0 +1,303 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+// Maximum number of bytes of stderr sent with a notification
+const stderrTailSize = 2048
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+type notifyConfig struct {
+	// webhook, email or chat
+	Type string `json:"type"`
+	// Only notify these acts (create, update, change, destroy); all if empty
+	Acts []string `json:"acts"`
+	// Only notify on success or on failure, including timeouts; all builds if empty
+	On string `json:"on"`
+	// Destination of webhook and chat notifications
+	URL string `json:"url"`
+	// SMTP server as host:port and addresses for email notifications
+	SMTP     string   `json:"smtp"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+}
+
+// wants returns true if the event should be sent according to the filters.
+func (c *notifyConfig) wants(ev *buildEvent) bool {
+	switch c.On {
+	case "success":
+		if !ev.Success {
+			return false
+		}
+	case "failure":
+		if ev.Success || ev.Status == store.BuildStatusCancelled.String() {
+			return false
+		}
+	}
+	if len(c.Acts) == 0 {
+		return true
+	}
+	for _, act := range c.Acts {
+		if act == ev.Act {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *notifyConfig) check(errs *configErrors, path string) {
+	switch c.Type {
+	case "webhook", "chat":
+		if c.URL == "" {
+			errs.add(path+".url", "required for %s notifications", c.Type)
+		}
+	case "email":
+		if c.SMTP == "" {
+			errs.add(path+".smtp", "required for email notifications")
+		}
+		if c.From == "" {
+			errs.add(path+".from", "required for email notifications")
+		}
+		if len(c.To) == 0 {
+			errs.add(path+".to", "required for email notifications")
+		}
+	default:
+		errs.add(path+".type", "unknown notification type %q, use webhook, email or chat", c.Type)
+	}
+	switch c.On {
+	case "", "success", "failure":
+	default:
+		errs.add(path+".on", "must be success or failure")
+	}
+	for i, act := range c.Acts {
+		switch act {
+		case "create", "update", "change", "destroy":
+		default:
+			errs.add(fmt.Sprintf("%s.acts[%d]", path, i), "unknown act %s", act)
+		}
+	}
+}
+
+// buildEvent is sent to the notifiers when a build command has run.
+type buildEvent struct {
+	Project string    `json:"project"`
+	Stage   string    `json:"stage"`
+	Branch  string    `json:"branch"`
+	SHA1    string    `json:"sha1"`
+	Ticket  int64     `json:"ticket"`
+	Act     string    `json:"act"`
+	Trigger string    `json:"trigger"`
+	User    string    `json:"user"`
+	Success bool      `json:"success"`
+	Status  string    `json:"status"`
+	Retval  int       `json:"retval"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	URL     string    `json:"url"`
+	Stderr  string    `json:"stderr"`
+	Error   string    `json:"error,omitempty"`
+}
+
+func newBuildEvent(b *build, req *buildReq, br *store.BuildResult, err error) *buildEvent {
+	ev := &buildEvent{
+		Project: b.project,
+		Stage:   b.stage,
+		Branch:  b.branch,
+		SHA1:    req.notif.sha1,
+		Ticket:  b.ticketNo,
+		Act:     req.act.String(),
+		Trigger: req.notif.trigger.String(),
+		User:    req.notif.user,
+		Success: err == nil,
+		Status:  resultStatus(err).String(),
+		URL:     b.srv.urls.lookup(b.stage).URL,
+	}
+	if br != nil {
+		ev.Retval = br.Retval
+		ev.Start = br.Start
+		ev.End = br.End
+		ev.Stderr = tail(br.Stderr, stderrTailSize)
+	}
+	if err != nil {
+		// The output is already in Stderr
+		if ee, ok := err.(*execError); ok {
+			err = ee.err
+		}
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+// tail returns the last size bytes of data, starting from a full line if possible.
+func tail(data []byte, size int) string {
+	if len(data) <= size {
+		return string(data)
+	}
+	data = data[len(data)-size:]
+	if i := bytes.IndexByte(data, '\n'); i >= 0 && i < len(data)-1 {
+		data = data[i+1:]
+	}
+	return string(data)
+}
+
+func (ev *buildEvent) outcome() string {
+	switch {
+	case ev.Success:
+		return "succeeded"
+	case ev.Status == store.BuildStatusCancelled.String():
+		return "was cancelled"
+	case ev.Status == store.BuildStatusTimedOut.String():
+		return "timed out"
+	case ev.Status == store.BuildStatusError.String():
+		return "could not start"
+	}
+	return "failed"
+}
+
+func (ev *buildEvent) summary() string {
+	return fmt.Sprintf("%s: %s of stage %s (branch %s) %s", ev.Project, ev.Act, ev.Stage, ev.Branch, ev.outcome())
+}
+
+// text returns a human readable description of the event.
+func (ev *buildEvent) text() string {
+	var buf bytes.Buffer
+	buf.WriteString(ev.summary())
+	buf.WriteString("\n")
+	if ev.SHA1 != "" {
+		fmt.Fprintf(&buf, "Revision: %s\n", ev.SHA1)
+	}
+	if ev.URL != "" {
+		fmt.Fprintf(&buf, "URL: %s\n", ev.URL)
+	}
+	if ev.Error != "" {
+		fmt.Fprintf(&buf, "Error: %s\n", ev.Error)
+	}
+	if !ev.Success && ev.Stderr != "" {
+		fmt.Fprintf(&buf, "\n%s", ev.Stderr)
+	}
+	return buf.String()
+}
+
+type notifier interface {
+	notify(ev *buildEvent) error
+}
+
+func newNotifier(c *notifyConfig) (notifier, error) {
+	switch c.Type {
+	case "webhook":
+		return &webhookNotifier{url: c.URL}, nil
+	case "chat":
+		return &chatNotifier{url: c.URL}, nil
+	case "email":
+		return &emailNotifier{conf: c}, nil
+	}
+	return nil, fmt.Errorf("unknown notification type %s", c.Type)
+}
+
+func postJSON(url string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := notifyClient.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: unexpected status %s", url, resp.Status)
+	}
+	return nil
+}
+
+// webhookNotifier posts the event as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (n *webhookNotifier) notify(ev *buildEvent) error {
+	return postJSON(n.url, ev)
+}
+
+// chatNotifier posts a message to an incoming webhook of Slack, Mattermost or compatible chats.
+type chatNotifier struct {
+	url string
+}
+
+func (n *chatNotifier) notify(ev *buildEvent) error {
+	text := ev.summary()
+	if ev.URL != "" {
+		text += "\n" + ev.URL
+	}
+	if !ev.Success {
+		if ev.Error != "" {
+			text += "\n" + ev.Error
+		}
+		if ev.Stderr != "" {
+			text += "\n```\n" + strings.TrimRight(ev.Stderr, "\n") + "\n```"
+		}
+	}
+	return postJSON(n.url, map[string]string{"text": text})
+}
+
+// emailNotifier sends a plain text email.
+type emailNotifier struct {
+	conf *notifyConfig
+}
+
+func (n *emailNotifier) notify(ev *buildEvent) error {
+	c := n.conf
+	var auth smtp.Auth
+	if c.Username != "" {
+		host := c.SMTP
+		if i := strings.LastIndexByte(host, ':'); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", c.Username, c.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [umarell] %s\r\n", ev.summary())
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(ev.text(), "\n", "\r\n", -1))
+	return smtp.SendMail(c.SMTP, auth, c.From, c.To, msg.Bytes())
+}
+
+// notifyBuild sends the event to all notifiers of the project in the background.
+func (s *server) notifyBuild(ev *buildEvent) {
+	confs := s.config().Envs[ev.Project].Notify
+	for i := range confs {
+		c := &confs[i]
+		if !c.wants(ev) {
+			continue
+		}
+		n, err := newNotifier(c)
+		if err != nil {
+			s.log.Errorf("[notify] %s: %s", ev.Project, err)
+			continue
+		}
+		go func(typ string) {
+			if err := n.notify(ev); err != nil {
+				s.log.with("project", ev.Project, "stage", ev.Stage).Errorf("[notify] cannot send %s notification: %s", typ, err)
+			}
+		}(c.Type)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNotifyConfigWants(t *testing.T) {
+	ok := &buildEvent{Act: "create", Success: true, Status: "success"}
+	failed := &buildEvent{Act: "destroy", Success: false, Status: "failed"}
+	cancelled := &buildEvent{Act: "change", Success: false, Status: "cancelled"}
+	c := &notifyConfig{On: "failure"}
+	if c.wants(ok) || !c.wants(failed) || c.wants(cancelled) {
+		t.Error("expected only failures")
+	}
+	c = &notifyConfig{Acts: []string{"create"}}
+	if !c.wants(ok) || c.wants(failed) {
+		t.Error("expected only create")
+	}
+}
+
+func TestTail(t *testing.T) {
+	if s := tail([]byte("short"), 10); s != "short" {
+		t.Errorf("unexpected tail %q", s)
+	}
+	if s := tail([]byte("first line\nsecond\nthird\n"), 10); s != "third\n" {
+		t.Errorf("unexpected tail %q", s)
+	}
+}
+
+func TestWebhookAndChatNotifiers(t *testing.T) {
+	bodies := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			t.Error(err)
+		}
+		bodies <- v
+	}))
+	defer ts.Close()
+
+	ev := &buildEvent{
+		Project: "projectNemo",
+		Stage:   "projectNemo.ticket12",
+		Branch:  "NEMO-12-test",
+		Act:     "create",
+		URL:     "https://nemo12.example.test/",
+		Stderr:  "deploy-tool: disk full\n",
+		Error:   "exit status 1",
+	}
+	for _, typ := range []string{"webhook", "chat"} {
+		n, err := newNotifier(&notifyConfig{Type: typ, URL: ts.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := n.notify(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v := <-bodies; v["stage"] != "projectNemo.ticket12" || v["success"] != false || v["stderr"] != ev.Stderr {
+		t.Errorf("unexpected webhook body %v", v)
+	}
+	text, _ := (<-bodies)["text"].(string)
+	for _, s := range []string{"create of stage projectNemo.ticket12 (branch NEMO-12-test) failed", ev.URL, "disk full"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("chat message does not contain %q: %s", s, text)
+		}
+	}
+}
@@ -15,14 +15,21 @@ type projectsAct int
 const (
 	projectsActPush projectsAct = iota
 	projectsActDestroy
+	projectsActInit
+	projectsActRemove
+	projectsActRedeploy
 )
 
 type projectsReq struct {
-	act   projectsAct
-	build *build
-	notif *notif
-	bot   *mergebot
-	token int64
+	act      projectsAct
+	build    *build
+	notif    *notif
+	bot      *mergebot
+	token    int64
+	project  string // for init and remove
+	redeploy *redeployReq
+	// Called when the build of a queued notification is done, can be nil
+	ack func()
 }
 
 func newProjectsReq(act projectsAct, b *build, n *notif, token int64, bot *mergebot) *projectsReq {
@@ -38,8 +45,10 @@ func newProjectsReq(act projectsAct, b *build, n *notif, token int64, bot *merge
 type projects struct {
 	stages map[string]*build // stage : build
 	tokens map[string]int64  // stage : number incremented at every deployment
-	reqs   chan *projectsReq
-	srv    *server
+	// Destroyed builds that might still be running
+	retired map[string]*build // stage : build
+	reqs    chan *projectsReq
+	srv     *server
 }
 
 type dirnotif struct {
@@ -83,35 +92,42 @@ func (b branchDirnotif) get(branch string) (*dirnotif, bool) {
 
 func newProjects(s *server, bots mergebots) *projects {
 	pjs := &projects{
-		stages: make(map[string]*build),
-		tokens: make(map[string]int64),
-		reqs:   make(chan *projectsReq),
-		srv:    s,
+		stages:  make(map[string]*build),
+		tokens:  make(map[string]int64),
+		retired: make(map[string]*build),
+		reqs:    make(chan *projectsReq),
+		srv:     s,
 	}
-	for name := range s.conf.Envs {
-		pjs.initProject(name, bots, s)
+	// Load first, initializing static stages saves the state
+	sts := s.states.load()
+	for name := range s.config().Envs {
+		bot := bots.create(name, s)
+		go bot.run(pjs)
+		pjs.initProject(name, bot)
 	}
+	pjs.restore(sts, bots)
+	pjs.reconcile(bots)
+	pjs.updateMetrics()
 	go pjs.run()
 	return pjs
 }
 
-func (p *projects) initProject(name string, bots mergebots, srv *server) {
-	envcf := srv.conf.Envs[name]
-	// Start a mergebot for this project
-	bot := bots.create(name, srv)
-	go bot.run(p)
+func (p *projects) initProject(name string, bot *mergebot) {
+	srv := p.srv
+	envcf := srv.config().Envs[name]
+	log := srv.log.with("project", name)
 	// Detect the last commit for each checked-out project
 	branchNotif := newBranchDirnotif(name)
 	for branch, dir := range envcf.Merges {
-		p.srv.log.Printf("[project] getting last commit for branch %s in %s", branch, dir)
+		log.Debugf("[project] getting last commit for branch %s in %s", branch, dir)
 		if err := branchNotif.add(branch, dir); err != nil {
-			p.srv.log.Printf("[project] %s: error initializing checked-out project: %s", name, err)
+			log.Errorf("[project] error initializing checked-out project: %s", err)
 		}
 	}
 	// Create builds for already existing static environments
 	for _, branch := range envcf.Statics {
 		if err := p.initStatic(branch, srv, bot, branchNotif); err != nil {
-			p.srv.log.Printf("[project] %s: cannot init static checkout: %s", name, err)
+			log.Errorf("[project] cannot init static checkout: %s", err)
 		}
 	}
 }
@@ -125,10 +141,27 @@ func (p *projects) initStatic(branch string, srv *server, bot *mergebot, bns *br
 	if len(builds) == 0 {
 		return fmt.Errorf("no static builds to manage for branch %s", branch)
 	}
-	for _, b := range builds {
-		p.stages[b.stage] = b
-		go b.run()
-		p.srv.log.Printf("[project] added stage %s tracking %s", b.stage, branch)
+	for i, b := range builds {
+		// Already initialized before a configuration reload
+		if existing, ok := p.stages[b.stage]; ok {
+			if i == 0 {
+				notifyMerge = false
+			}
+			builds[i] = existing
+			continue
+		}
+		p.start(b)
+		srv.urls.set(b.stage, b.links(branch))
+		if _, ok := srv.states.get(b.stage); !ok {
+			srv.states.set(&stageState{
+				Project: b.project,
+				Stage:   b.stage,
+				Branch:  branch,
+				SHA1:    bn.notif.sha1,
+				Ticket:  b.ticketNo,
+			})
+		}
+		b.logger().with("branch", branch).Printf("[project] added stage")
 		bot.addUnremovable(b.stage)
 	}
 	// Notify the merge detector that this is the current build and notif for this directory
@@ -138,9 +171,87 @@ func (p *projects) initStatic(branch string, srv *server, bot *mergebot, bns *br
 	return nil
 }
 
+// doRemove stops tracking the stages of a project removed from the configuration.
+// The environments are not destroyed.
+func (p *projects) doRemove(project string) {
+	for stage, b := range p.stages {
+		if b.project != project {
+			continue
+		}
+		p.retire(b)
+		delete(p.tokens, stage)
+		p.srv.urls.del(stage)
+		p.srv.states.del(stage)
+		b.logger().Printf("[project] stopped tracking stage")
+	}
+}
+
+// restore recreates the stages that were live before a restart.
+func (p *projects) restore(sts []*stageState, bots mergebots) {
+	for _, st := range sts {
+		if err := p.restoreStage(st, bots); err != nil {
+			p.srv.log.with("project", st.Project, "stage", st.Stage).Errorf("[project] cannot restore stage: %s", err)
+			p.srv.states.del(st.Stage)
+		}
+	}
+}
+
+func (p *projects) restoreStage(st *stageState, bots mergebots) error {
+	bot := bots.get(st.Project)
+	if bot == nil {
+		return fmt.Errorf("project %s not configured", st.Project)
+	}
+	n := newNotif(st.Project, st.SHA1, st.Branch, notifPush)
+	b, ok := p.stages[st.Stage]
+	if !ok {
+		builds, err := newBuilds(n, p.srv)
+		if err != nil {
+			return err
+		}
+		for _, nb := range builds {
+			if nb.stage == st.Stage {
+				b = nb
+				break
+			}
+		}
+		if b == nil {
+			return fmt.Errorf("branch %s does not build stage %s anymore", st.Branch, st.Stage)
+		}
+		p.start(b)
+	}
+	p.srv.urls.set(b.stage, b.links(st.Branch))
+	p.tokens[b.stage] = st.Token
+	if st.SHA1 != "" {
+		req := newMergereq(n, st.Token, b)
+		req.restore = true
+		bot.send(req)
+	}
+	b.logger().with("branch", st.Branch, "sha1", st.SHA1, "token", st.Token).Printf("[project] restored stage")
+	return nil
+}
+
+func (p *projects) saveState(req *projectsReq) {
+	b := req.build
+	p.srv.states.set(&stageState{
+		Project: b.project,
+		Stage:   b.stage,
+		Branch:  req.notif.branch,
+		SHA1:    req.notif.sha1,
+		Ticket:  b.ticketNo,
+		Token:   req.token,
+		URL:     p.srv.urls.lookup(b.stage).URL,
+	})
+}
+
 func (p *projects) run() {
 	for req := range p.reqs {
-		var err error
+		var (
+			err error
+			log = p.srv.log
+		)
+		if req.build != nil {
+			log = req.build.logger().with("branch", req.notif.branch, "sha1", req.notif.sha1, "token", req.token)
+		}
 		switch req.act {
 		case projectsActPush:
 			p.tokens[req.build.stage]++
@@ -149,7 +260,8 @@ func (p *projects) run() {
 		case projectsActDestroy:
 			token, ok := p.tokens[req.build.stage]
 			if !ok {
-				p.srv.log.Printf("[project] skipping ghost merge request for %s", req.build.stage)
+				log.Printf("[project] skipping ghost merge request for %s", req.build.stage)
+				req.done()
 				continue
 			}
 			// We can accept a merge notification if there have been no new
@@ -161,51 +273,113 @@ func (p *projects) run() {
 				err = p.doDestroy(req)
 				delete(p.tokens, req.build.stage)
 				p.srv.urls.del(req.build.stage)
+				p.srv.states.del(req.build.stage)
 			} else {
-				p.srv.log.Printf("[project] ignoring merge request for %s as it is not up-to-date", req.build.stage)
+				log.Printf("[project] ignoring merge request for %s as it is not up-to-date", req.build.stage)
+				req.done()
 			}
+		case projectsActInit:
+			p.initProject(req.project, req.bot)
+		case projectsActRemove:
+			p.doRemove(req.project)
+		case projectsActRedeploy:
+			p.doRedeploy(req.redeploy)
 		}
 		if err != nil {
-			p.srv.log.Printf("[project] error processing build action: %s", err)
+			log.Errorf("[project] error processing build action: %s", err)
 		}
+		p.updateMetrics()
 	}
 }
 
-func (p *projects) push(b *build, n *notif, bot *mergebot) {
-	p.reqs <- newProjectsReq(projectsActPush, b, n, 0, bot)
+// updateMetrics reports the number of live stages of each project.
+func (p *projects) updateMetrics() {
+	counts := make(map[string]int)
+	for _, b := range p.stages {
+		counts[b.project]++
+	}
+	p.srv.metrics.setStages(counts)
+}
+
+func (r *projectsReq) done() {
+	if r.ack != nil {
+		r.ack()
+	}
+}
+
+func (p *projects) push(b *build, n *notif, bot *mergebot, ack func()) {
+	req := newProjectsReq(projectsActPush, b, n, 0, bot)
+	req.ack = ack
+	p.reqs <- req
+}
+
+func (p *projects) destroy(b *build, n *notif, token int64, ack func()) {
+	req := newProjectsReq(projectsActDestroy, b, n, token, nil)
+	req.ack = ack
+	p.reqs <- req
+}
+
+// start runs a new build for a stage, after the one it replaces is done.
+func (p *projects) start(b *build) {
+	if old, ok := p.retired[b.stage]; ok {
+		b.prev = old.finished
+		delete(p.retired, b.stage)
+	}
+	p.stages[b.stage] = b
+	go b.run()
+}
+
+// retire stops accepting requests for a stage, pending ones are still run.
+func (p *projects) retire(b *build) {
+	b.destroy()
+	delete(p.stages, b.stage)
+	p.retired[b.stage] = b
+}
+
+func (p *projects) init(project string, bot *mergebot) {
+	req := newProjectsReq(projectsActInit, nil, nil, 0, bot)
+	req.project = project
+	p.reqs <- req
 }
 
-func (p *projects) destroy(b *build, n *notif, token int64) {
-	p.reqs <- newProjectsReq(projectsActDestroy, b, n, token, nil)
+func (p *projects) remove(project string) {
+	req := newProjectsReq(projectsActRemove, nil, nil, 0, nil)
+	req.project = project
+	p.reqs <- req
 }
 
 // A branch has been pushed: create env or deploy to existing
 func (p *projects) doPush(req *projectsReq) error {
 	var act store.BuildAct
 	if existingBuild, ok := p.stages[req.build.stage]; !ok {
-		p.srv.urls.set(req.build.stage, req.build.url(reverseJenkinsURL)) // TODO: Using global here sucks.
-		p.stages[req.build.stage] = req.build
+		p.srv.urls.set(req.build.stage, req.build.links(req.notif.branch))
 		act = store.BuildActCreate
-		go req.build.run()
+		p.start(req.build)
 	} else {
 		// If the branch is the same as last seen, act will be treated as Update
 		act = store.BuildActChange
 		req.build = existingBuild
 	}
-	req.build.request(act, req.notif)
-	req.bot.send(newMergereq(req.notif, req.token, req.build))
+	p.saveState(req)
+	// Check for merges after the checkout has been deployed
+	req.build.enqueue(act, req.notif, req.token, func(*store.BuildResult) {
+		req.bot.send(newMergereq(req.notif, req.token, req.build))
+		req.done()
+	})
 	return nil
 }
 
 func (p *projects) doDestroy(req *projectsReq) error {
 	stage := req.build.stage
-	p.srv.log.Printf("[project] remove build stage %s", stage)
+	req.build.logger().Printf("[project] remove build stage")
 	build, ok := p.stages[stage]
 	if !ok {
+		req.done()
 		return fmt.Errorf("unknown stage %s merged", stage)
 	}
-	build.request(store.BuildActDestroy, req.notif)
-	build.destroy()
-	delete(p.stages, stage)
+	build.enqueue(store.BuildActDestroy, req.notif, req.token, func(*store.BuildResult) {
+		req.done()
+	})
+	p.retire(build)
 	return nil
 }
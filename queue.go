@@ -0,0 +1,273 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+// Notifications that can wait to be handled when queue_size is not set
+const defaultQueueSize = 1000
+
+var errQueueFull = errors.New("too many notifications queued, retry later")
+
+// journalEntry is a line of the journal: a queued notification or
+// the acknowledgement that notification id has been fully handled.
+type journalEntry struct {
+	ID      int64  `json:"id"`
+	Done    bool   `json:"done,omitempty"`
+	Project string `json:"project,omitempty"`
+	SHA1    string `json:"sha1,omitempty"`
+	Branch  string `json:"branch,omitempty"`
+	Delete  bool   `json:"delete,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+	Trigger int    `json:"trigger,omitempty"`
+	User    string `json:"user,omitempty"`
+	// Nil for acknowledgements
+	Queued *time.Time `json:"queued,omitempty"`
+}
+
+func newJournalEntry(n *notif) *journalEntry {
+	return &journalEntry{
+		ID:      n.id,
+		Project: n.project,
+		SHA1:    n.sha1,
+		Branch:  n.branch,
+		Delete:  n.ntype == notifDelete,
+		Removed: n.removed,
+		Trigger: int(n.trigger),
+		User:    n.user,
+		Queued:  &n.queued,
+	}
+}
+
+func (e *journalEntry) notif() *notif {
+	n := &notif{
+		id:      e.ID,
+		project: e.Project,
+		sha1:    e.SHA1,
+		branch:  e.Branch,
+		ntype:   notifPush,
+		removed: e.Removed,
+		trigger: store.BuildTrigger(e.Trigger),
+		user:    e.User,
+	}
+	if e.Queued != nil {
+		n.queued = *e.Queued
+	}
+	if e.Delete {
+		n.ntype = notifDelete
+	}
+	return n
+}
+
+// notifQueue holds the notifications accepted but not handled yet. If a
+// journal file is set, notifications are kept there until all their builds
+// are done and are queued again after a restart.
+type notifQueue struct {
+	mux     sync.Mutex
+	ch      chan *notif
+	lastID  int64
+	pending int // notifications queued or with builds running
+	journal *os.File
+	log     logger
+}
+
+func newNotifQueue(size int, fname string, log logger) (*notifQueue, error) {
+	if size <= 0 {
+		size = defaultQueueSize
+	}
+	q := &notifQueue{log: log}
+	var entries []*journalEntry
+	if fname != "" {
+		var err error
+		if entries, err = q.replay(fname); err != nil {
+			return nil, err
+		}
+		if q.journal, err = compactJournal(fname, entries, q.lastID); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) > size {
+		size = len(entries)
+	}
+	q.ch = make(chan *notif, size)
+	for _, e := range entries {
+		q.ch <- e.notif()
+		q.pending++
+	}
+	if len(entries) > 0 {
+		log.Printf("[queue] %d notifications recovered from journal", len(entries))
+	}
+	return q, nil
+}
+
+// replay returns the notifications of the journal that were not done.
+func (q *notifQueue) replay(fname string) ([]*journalEntry, error) {
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open queue journal: %s", err)
+	}
+	defer f.Close()
+	queued := make(map[int64]*journalEntry)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// A crash can leave the last line incomplete
+			q.log.Errorf("[queue] %s:%d: skipping invalid journal entry: %s", fname, line, err)
+			continue
+		}
+		if e.ID > q.lastID {
+			q.lastID = e.ID
+		}
+		if e.Done {
+			delete(queued, e.ID)
+		} else {
+			queued[e.ID] = &e
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read queue journal: %s", err)
+	}
+	entries := make([]*journalEntry, 0, len(queued))
+	for _, e := range queued {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries, nil
+}
+
+// lastIDEntry keeps track of the last id used when no notification is pending.
+func lastIDEntry(entries []*journalEntry, lastID int64) *journalEntry {
+	if lastID == 0 || (len(entries) > 0 && entries[len(entries)-1].ID == lastID) {
+		return nil
+	}
+	return &journalEntry{ID: lastID, Done: true}
+}
+
+// compactJournal rewrites the journal with only entries and opens it for appending.
+func compactJournal(fname string, entries []*journalEntry, lastID int64) (*os.File, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return nil, fmt.Errorf("cannot write queue journal: %s", err)
+	}
+	enc := json.NewEncoder(tmp)
+	if e := lastIDEntry(entries, lastID); e != nil {
+		err = enc.Encode(e)
+	}
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(e)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fname)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, fmt.Errorf("cannot write queue journal: %s", err)
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open queue journal: %s", err)
+	}
+	return f, nil
+}
+
+// write must be called with the lock held.
+func (q *notifQueue) write(e *journalEntry) error {
+	if q.journal == nil || e == nil {
+		return nil
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = q.journal.Write(append(data, '\n'))
+	return err
+}
+
+// enqueue accepts a notification and returns its id without waiting for it to be handled.
+func (q *notifQueue) enqueue(n *notif) (int64, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.ch) == cap(q.ch) {
+		return 0, errQueueFull
+	}
+	n.id = q.lastID + 1
+	n.queued = time.Now()
+	if err := q.write(newJournalEntry(n)); err != nil {
+		return 0, fmt.Errorf("cannot write queue journal: %s", err)
+	}
+	q.lastID = n.id
+	q.pending++
+	q.ch <- n
+	return n.id, nil
+}
+
+// done removes notification id from the journal.
+func (q *notifQueue) done(id int64) {
+	if id == 0 {
+		return
+	}
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	q.pending--
+	if err := q.write(&journalEntry{ID: id, Done: true}); err != nil {
+		q.log.Errorf("[queue] cannot write queue journal: %s", err)
+	}
+	// Nothing to recover, start over
+	if q.pending == 0 && q.journal != nil {
+		if err := q.journal.Truncate(0); err != nil {
+			q.log.Errorf("[queue] cannot truncate queue journal: %s", err)
+		} else if err := q.write(lastIDEntry(nil, q.lastID)); err != nil {
+			q.log.Errorf("[queue] cannot write queue journal: %s", err)
+		}
+	}
+}
+
+// acker returns a function to call when each of count builds of notification
+// id is done. The notification is done after the last call.
+func (q *notifQueue) acker(id int64, count int) func() {
+	if count <= 0 {
+		q.done(id)
+		return nil
+	}
+	left := int32(count)
+	return func() {
+		if atomic.AddInt32(&left, -1) == 0 {
+			q.done(id)
+		}
+	}
+}
+
+// enqueue accepts a notification to be handled in the background.
+func (s *server) enqueue(n *notif) (int64, error) {
+	return s.queue.enqueue(n)
+}
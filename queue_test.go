@@ -0,0 +1,90 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestNotifQueueJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umarell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "queue.journal")
+
+	q, err := newNotifQueue(10, fname, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, branch := range []string{"NEMO-12-test", "NEMO-13-test", "NEMO-14-test"} {
+		n := newNotif("projectNemo", "0ff715f", branch, notifPush).triggered(store.BuildTriggerAPI, "ci")
+		if _, err := q.enqueue(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two builds for the first notification, one done
+	ack := q.acker((<-q.ch).id, 2)
+	ack()
+	q.done((<-q.ch).id)
+	q.journal.Close()
+
+	q, err = newNotifQueue(10, fname, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.ch) != 2 {
+		t.Fatalf("expected two notifications recovered, got %d", len(q.ch))
+	}
+	if n := <-q.ch; n.id != 1 || n.branch != "NEMO-12-test" {
+		t.Errorf("unexpected first notification %d %s", n.id, n.branch)
+	}
+	n := <-q.ch
+	if n.id != 3 || n.branch != "NEMO-14-test" {
+		t.Errorf("unexpected second notification %d %s", n.id, n.branch)
+	}
+	if n.trigger != store.BuildTriggerAPI || n.user != "ci" || n.queued.IsZero() {
+		t.Errorf("origin of notification lost: %s %s %s", n.trigger, n.user, n.queued)
+	}
+	q.done(1)
+	q.done(3)
+	q.journal.Close()
+
+	// Ids are not reused after the journal is emptied
+	q, err = newNotifQueue(10, fname, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.journal.Close()
+	if len(q.ch) != 0 {
+		t.Fatalf("expected no notifications recovered, got %d", len(q.ch))
+	}
+	id, err := q.enqueue(newNotif("projectNemo", "", "NEMO-12-test", notifDelete))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 4 {
+		t.Errorf("expected id 4, got %d", id)
+	}
+}
+
+func TestNotifQueueFull(t *testing.T) {
+	q, err := newNotifQueue(1, "", discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.enqueue(newNotif("projectNemo", "0ff715f", "master", notifPush)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.enqueue(newNotif("projectNemo", "0ff715f", "master", notifPush)); err != errQueueFull {
+		t.Errorf("expected queue full, got %v", err)
+	}
+}
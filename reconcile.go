@@ -0,0 +1,102 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+// liveFromHistory returns the state of a stage that has been deployed and
+// never destroyed according to its build results, newest first. Only
+// successful builds deploy or destroy a stage and the state is the one of
+// the last successful deployment. The token is the number of deployments
+// requested since the stage was last destroyed.
+func liveFromHistory(brs []*store.BuildResult) (*stageState, bool) {
+	var (
+		st     *stageState
+		tokens int64
+	)
+	for _, br := range brs {
+		if br.Act == store.BuildActDestroy {
+			if br.Status == store.BuildStatusSuccess {
+				break
+			}
+			continue
+		}
+		tokens++
+		if st == nil && br.Status == store.BuildStatusSuccess {
+			st = &stageState{
+				Stage:  br.Stage,
+				Branch: br.Branch,
+				SHA1:   br.SHA1,
+				Ticket: br.Ticket,
+			}
+		}
+	}
+	if st == nil {
+		return nil, false
+	}
+	st.Token = tokens
+	return st, true
+}
+
+// stageProject returns the configured project that builds stage from branch.
+func (s *server) stageProject(stage, branch string) (string, error) {
+	conf := s.config()
+	names := make([]string, 0, len(conf.Envs))
+	for name := range conf.Envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		builds, err := newBuilds(newNotif(name, "", branch, notifPush), s)
+		if err != nil {
+			continue
+		}
+		for _, b := range builds {
+			if b.stage == stage {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no project builds stage %s from branch %s", stage, branch)
+}
+
+// reconcile registers the stages that the build history shows as live
+// but that are not known yet, for example because no state was saved.
+func (p *projects) reconcile(bots mergebots) {
+	stages, err := p.srv.storage.Stages()
+	if err != nil {
+		p.srv.log.Errorf("[project] cannot read build history: %s", err)
+		return
+	}
+	for _, stage := range stages {
+		if _, ok := p.stages[stage]; ok {
+			continue
+		}
+		brs, err := p.srv.storage.List(stage, 0, 0)
+		if err != nil {
+			p.srv.log.Errorf("[project] cannot read build history of %s: %s", stage, err)
+			continue
+		}
+		st, live := liveFromHistory(brs)
+		if !live {
+			continue
+		}
+		if st.Project, err = p.srv.stageProject(st.Stage, st.Branch); err != nil {
+			p.srv.log.Errorf("[project] cannot reconcile stage %s: %s", stage, err)
+			continue
+		}
+		if err := p.restoreStage(st, bots); err != nil {
+			p.srv.log.Errorf("[project] cannot reconcile stage %s: %s", stage, err)
+			continue
+		}
+		st.URL = p.srv.urls.lookup(stage).URL
+		p.srv.states.set(st)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"testing"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestLiveFromHistory(t *testing.T) {
+	// Newest first, as returned by the store
+	brs := []*store.BuildResult{
+		{Act: store.BuildActUpdate, Stage: "projectNemo.ticket12", Branch: "NEMO-12-test", SHA1: "b72759c"},
+		{Act: store.BuildActCreate, Stage: "projectNemo.ticket12", Branch: "NEMO-12-test", SHA1: "0ff715f"},
+		{Act: store.BuildActDestroy, Stage: "projectNemo.ticket12", Branch: "NEMO-12-old"},
+		{Act: store.BuildActCreate, Stage: "projectNemo.ticket12", Branch: "NEMO-12-old"},
+	}
+	st, live := liveFromHistory(brs)
+	if !live {
+		t.Fatal("expected stage to be live")
+	}
+	if st.SHA1 != "b72759c" || st.Branch != "NEMO-12-test" || st.Token != 2 {
+		t.Errorf("unexpected state %+v", st)
+	}
+	if _, live := liveFromHistory(brs[2:]); live {
+		t.Error("expected destroyed stage not to be live")
+	}
+}
+
+func TestLiveFromHistoryStatus(t *testing.T) {
+	// Builds that did not run or failed to create the stage do not make it live
+	brs := []*store.BuildResult{
+		{Act: store.BuildActUpdate, Status: store.BuildStatusSkipped, SHA1: "3cc042c"},
+		{Act: store.BuildActUpdate, Status: store.BuildStatusCancelled, SHA1: "2dd933d"},
+		{Act: store.BuildActCreate, Status: store.BuildStatusFailed, SHA1: "1ee824e"},
+		{Act: store.BuildActDestroy},
+		{Act: store.BuildActCreate, SHA1: "0ff715f"},
+	}
+	if st, live := liveFromHistory(brs); live {
+		t.Errorf("expected stage not to be live, got %+v", st)
+	}
+	// A failed destroy leaves the stage live at its last successful deployment
+	brs = []*store.BuildResult{
+		{Act: store.BuildActDestroy, Status: store.BuildStatusFailed},
+		{Act: store.BuildActUpdate, Status: store.BuildStatusTimedOut, SHA1: "1ee824e"},
+		{Act: store.BuildActCreate, SHA1: "0ff715f"},
+	}
+	st, live := liveFromHistory(brs)
+	if !live {
+		t.Fatal("expected stage to be live after a failed destroy")
+	}
+	if st.SHA1 != "0ff715f" || st.Token != 2 {
+		t.Errorf("unexpected state %+v", st)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"fmt"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+type redeployResult struct {
+	token int64
+	err   error
+}
+
+type redeployReq struct {
+	project string
+	stage   string
+	trigger store.BuildTrigger
+	user    string
+	result  chan *redeployResult
+}
+
+func newRedeployReq(project, stage string, trigger store.BuildTrigger, user string) *redeployReq {
+	return &redeployReq{
+		project: project,
+		stage:   stage,
+		trigger: trigger,
+		user:    user,
+		result:  make(chan *redeployResult, 1),
+	}
+}
+
+func (r *redeployReq) reply(token int64, err error) {
+	r.result <- &redeployResult{token: token, err: err}
+}
+
+func (r *redeployReq) wait() (int64, error) {
+	res := <-r.result
+	return res.token, res.err
+}
+
+// redeploy queues the update command of a live stage with its current
+// branch and revision and returns the token of the new deployment,
+// without waiting for the command to run.
+func (s *server) redeploy(project, stage string, trigger store.BuildTrigger, user string) (int64, error) {
+	req := newRedeployReq(project, stage, trigger, user)
+	s.redeploys <- req
+	return req.wait()
+}
+
+func (p *projects) redeploy(rr *redeployReq) {
+	req := newProjectsReq(projectsActRedeploy, nil, nil, 0, nil)
+	req.redeploy = rr
+	p.reqs <- req
+}
+
+// doRedeploy must be called from the projects goroutine.
+func (p *projects) doRedeploy(rr *redeployReq) {
+	b, ok := p.stages[rr.stage]
+	if !ok || b.project != rr.project {
+		rr.reply(0, store.ErrNotFound)
+		return
+	}
+	st, ok := p.srv.states.get(b.stage)
+	if !ok {
+		rr.reply(0, fmt.Errorf("stage %s has no known revision", b.stage))
+		return
+	}
+	p.tokens[b.stage]++
+	n := newNotif(b.project, st.SHA1, st.Branch, notifPush).triggered(rr.trigger, rr.user)
+	req := newProjectsReq(projectsActRedeploy, b, n, p.tokens[b.stage], nil)
+	p.saveState(req)
+	p.srv.log.with("project", b.project, "stage", b.stage, "sha1", st.SHA1, "token", req.token).Printf("[project] redeploying stage")
+	b.enqueue(store.BuildActUpdate, req.notif, req.token, nil)
+	rr.reply(req.token, nil)
+}
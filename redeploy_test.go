@@ -0,0 +1,94 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestRedeploy(t *testing.T) {
+	s := NewServer(newTestConfig(commandsConfig{
+		CmdCreate: []string{"echo", "create", "{STAGE}"},
+		CmdUpdate: []string{"echo", "update", "{STAGE}", "{BRANCH}"},
+	}, "projectNemo"))
+	go s.ServeReqs()
+
+	if _, err := s.redeploy("projectNemo", "projectNemo.ticket12", store.BuildTriggerManual, "giulio"); err != store.ErrNotFound {
+		t.Fatalf("expected stage not found, got %v", err)
+	}
+	if _, err := s.enqueue(newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush)); err != nil {
+		t.Fatal(err)
+	}
+	waitStage(t, s, "projectNemo.ticket12")
+	token, err := s.redeploy("projectNemo", "projectNemo.ticket12", store.BuildTriggerManual, "giulio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != 2 {
+		t.Errorf("expected redeploy to count as a deployment, token is %d", token)
+	}
+	// The update runs in the background after the create
+	var brs []*store.BuildResult
+	waitFor(t, "redeploy run", func() bool {
+		brs, _ = s.storage.Get("projectNemo.ticket12")
+		return len(brs) == 2
+	})
+	br := brs[1]
+	if br.ID != 2 || br.Act != store.BuildActUpdate || br.SHA1 != "0ff715f" {
+		t.Errorf("unexpected build result %+v", br)
+	}
+	if br.Project != "projectNemo" || br.Trigger != store.BuildTriggerManual || br.User != "giulio" || br.Token != 2 {
+		t.Errorf("unexpected build origin %s %s %s %d", br.Project, br.Trigger, br.User, br.Token)
+	}
+	if out := string(br.Stdout); out != "update projectNemo.ticket12 NEMO-12-test\n" {
+		t.Errorf("unexpected output %q", out)
+	}
+	if st, _ := s.states.get("projectNemo.ticket12"); st.Token != 2 {
+		t.Errorf("expected redeploy to count as a deployment, token is %d", st.Token)
+	}
+}
+
+func TestRedeployHandler(t *testing.T) {
+	s := NewServer(newTestConfig(commandsConfig{
+		CmdCreate: []string{"echo", "create", "{STAGE}"},
+		CmdUpdate: []string{"echo", "update", "{STAGE}"},
+	}, "projectNemo"))
+	go s.ServeReqs()
+	if _, err := s.enqueue(newNotif("projectNemo", "0ff715f", "NEMO-12-test", notifPush)); err != nil {
+		t.Fatal(err)
+	}
+	waitStage(t, s, "projectNemo.ticket12")
+
+	r := s.router()
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/projectNemo/stages/projectNemo.ticket12/redeploy", nil))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	var rd redeployJSON
+	if err := json.NewDecoder(w.Body).Decode(&rd); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Token != 2 || rd.Builds != "/projectNemo/stages/projectNemo.ticket12/builds?deployment=2" {
+		t.Fatalf("unexpected response %+v", rd)
+	}
+	// The builds URL lists the update once it has run, and only it
+	var list []*buildJSON
+	waitFor(t, "redeploy listed", func() bool {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", rd.Builds, nil))
+		list = nil
+		json.NewDecoder(w.Body).Decode(&list)
+		return len(list) > 0
+	})
+	if len(list) != 1 || list[0].Act != "update" || list[0].Token != 2 {
+		t.Errorf("unexpected builds %+v", list)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"errors"
+)
+
+type reloadReq struct {
+	conf   *config
+	doneCh chan struct{}
+}
+
+func newReloadReq(c *config) *reloadReq {
+	return &reloadReq{
+		conf:   c,
+		doneCh: make(chan struct{}),
+	}
+}
+
+func (r *reloadReq) done() {
+	close(r.doneCh)
+}
+
+func (r *reloadReq) wait() {
+	<-r.doneCh
+}
+
+// Reload reads again the configuration file and applies it. Projects are
+// started or stopped and commands are changed for all following builds.
+// If the new configuration is invalid, the current one is kept.
+func (s *server) Reload() error {
+	fname := s.config().fname
+	if fname == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+	c, err := NewConfigFile(fname)
+	if err != nil {
+		return err
+	}
+	req := newReloadReq(c)
+	s.reloads <- req
+	req.wait()
+	return nil
+}
+
+// applyConfig must be called from the goroutine serving notifications,
+// as it owns the mergebots.
+func (s *server) applyConfig(c *config, bots mergebots, pros *projects) {
+	old := s.config()
+	s.warnRestart(old, c)
+	s.warnConfig(c)
+	s.setConfig(c)
+	for name := range old.Envs {
+		if _, ok := c.Envs[name]; ok {
+			continue
+		}
+		s.log.Printf("[server] reload: removing project %s", name)
+		pros.remove(name)
+		bots.remove(name)
+	}
+	for name := range c.Envs {
+		bot := bots.get(name)
+		if bot == nil {
+			s.log.Printf("[server] reload: adding project %s", name)
+			bot = bots.create(name, s)
+			go bot.run(pros)
+		}
+		// Also initializes new static branches of existing projects
+		pros.init(name, bot)
+	}
+	s.log.Printf("[server] configuration reloaded from %s", c.fname)
+}
+
+// warnConfig logs the warnings about c.
+func (s *server) warnConfig(c *config) {
+	for _, w := range c.Warnings() {
+		s.log.Printf("[server] warning: %s", w)
+	}
+}
+
+// warnRestart logs the settings that are only read at startup.
+func (s *server) warnRestart(old, c *config) {
+	changed := func(name string, differ bool) {
+		if differ {
+			s.log.Printf("[server] reload: changes to %s require a restart", name)
+		}
+	}
+	changed("database", old.Database != c.Database || old.Table != c.Table)
+	changed("state_file", old.StateFile != c.StateFile)
+	changed("logging", old.LogFormat != c.LogFormat || old.LogLevel != c.LogLevel)
+	changed("limit_builds", old.LimitBuilds != c.LimitBuilds)
+	changed("queue", old.QueueSize != c.QueueSize || old.QueueJournal != c.QueueJournal)
+	changed("results_duration", old.ResultsDuration != c.ResultsDuration || old.ResultsCleanup != c.ResultsCleanup)
+}
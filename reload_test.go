@@ -0,0 +1,105 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer collects the logs written by several goroutines.
+type syncBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.String()
+}
+
+func TestApplyConfig(t *testing.T) {
+	cmds := commandsConfig{CmdCreate: []string{"echo", "create", "{STAGE}"}}
+	s := NewServer(newTestConfig(cmds, "projectNemo", "projectDory"))
+	var buf syncBuffer
+	s.log, _ = newLogger(&buf, "text", "info")
+	bots := makeMergebots()
+	pros := newProjects(s, bots)
+
+	s.handleNotif(newNotif("projectDory", "0ff715f", "DORY-7-test", notifPush), bots, pros)
+	waitStage(t, s, "projectDory.ticket7")
+	dory := bots.get("projectDory")
+
+	c := newTestConfig(cmds, "projectNemo", "projectShark")
+	c.LimitBuilds = 2
+	s.applyConfig(c, bots, pros)
+	if bots.get("projectDory") != nil {
+		t.Error("mergebot of removed project still registered")
+	}
+	select {
+	case <-dory.quit:
+	default:
+		t.Error("mergebot of removed project not stopped")
+	}
+	if bots.get("projectNemo") == nil || bots.get("projectShark") == nil {
+		t.Fatal("expected mergebots for the kept and added projects")
+	}
+	// Requests are handled in order, the removal is done once the new project deploys
+	s.handleNotif(newNotif("projectShark", "1ee824e", "SHARK-9-test", notifPush), bots, pros)
+	waitStage(t, s, "projectShark.ticket9")
+	if _, ok := s.states.get("projectDory.ticket7"); ok {
+		t.Error("stage of removed project still tracked")
+	}
+
+	logs := buf.String()
+	for _, msg := range []string{
+		"removing project projectDory",
+		"adding project projectShark",
+		"changes to limit_builds require a restart",
+	} {
+		if !strings.Contains(logs, msg) {
+			t.Errorf("expected %q in logs:\n%s", msg, logs)
+		}
+	}
+	if strings.Contains(logs, "changes to database") {
+		t.Errorf("unexpected restart warning:\n%s", logs)
+	}
+}
+
+func TestReloadInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umarell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "umarell.json")
+	if err := ioutil.WriteFile(fname, []byte(`{"branch_regexp": "(", "environments": {}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestConfig(commandsConfig{}, "projectNemo")
+	s := &server{conf: c, log: discardLogger}
+	if err := s.Reload(); err == nil {
+		t.Error("expected error reloading a configuration not read from a file")
+	}
+	c.fname = fname
+	if err := s.Reload(); err == nil {
+		t.Error("expected invalid configuration to be refused")
+	}
+	if s.config() != c {
+		t.Error("invalid configuration applied")
+	}
+}
@@ -6,7 +6,9 @@ package umarell
 
 import (
 	"fmt"
+	"os"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/dullgiulio/umarell/store"
@@ -19,66 +21,140 @@ const (
 	notifDelete
 )
 
+func (t notifType) String() string {
+	switch t {
+	case notifPush:
+		return "push"
+	case notifDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// SHA1 used by git to represent a missing ref, as in a deleted branch
+const zeroSHA1 = "0000000000000000000000000000000000000000"
+
 type notif struct {
+	id      int64 // in the queue, zero if not queued
 	project string
 	sha1    string
 	branch  string
 	ntype   notifType
+	// The branch has been deleted upstream
+	removed bool
+	// What requested the notification and on behalf of whom, if known
+	trigger store.BuildTrigger
+	user    string
+	// When it was accepted in the queue
+	queued time.Time
 }
 
+// newNotif returns a new notification. A push of the zero SHA1 is
+// the deletion of the branch and is turned into a delete notification.
 func newNotif(project, sha1, branch string, ntype notifType) *notif {
-	return &notif{
+	n := &notif{
 		project: project,
 		sha1:    sha1,
 		branch:  branch,
 		ntype:   ntype,
 	}
+	if ntype == notifPush && sha1 == zeroSHA1 {
+		n.ntype = notifDelete
+		n.sha1 = ""
+		n.removed = true
+	}
+	return n
+}
+
+// triggered returns a copy of n requested by trigger on behalf of user.
+func (n *notif) triggered(trigger store.BuildTrigger, user string) *notif {
+	c := *n
+	c.trigger = trigger
+	c.user = user
+	return &c
 }
 
 func (n *notif) String() string {
 	return fmt.Sprintf("%s: %s: %s", n.project, n.branch, n.sha1)
 }
 
+// logger returns l with the fields of the notification.
+func (n *notif) logger(l logger) logger {
+	return l.with("project", n.project, "branch", n.branch, "sha1", n.sha1)
+}
+
 func (n *notif) equal(o *notif) bool {
 	return n.project == o.project && n.branch == o.branch && n.sha1 == o.sha1
 }
 
 type server struct {
-	notifs      chan *notif
-	conf        *config
-	regexBranch *regexp.Regexp
+	queue   *notifQueue
+	reloads chan *reloadReq
+	// Manual deployments of a live stage
+	redeploys chan *redeployReq
+	// Protects conf, that is replaced when reloading
+	confMux sync.RWMutex
+	conf    *config
 	// Limit the number of concurrent builds that can be performed
 	limitBuilds chan struct{}
 	storage     store.Store
 	urls        *urls
+	states      *stageStates
+	lives       *liveLogs
+	metrics     *metrics
+	statuses    chan *commitStatus
 	log         logger
 	cleanup     chan struct{}
 }
 
 func NewServer(c *config) *server {
 	s := &server{
-		notifs: make(chan *notif),
-		conf:   c,
-		log:    newStdLogger(),
+		reloads:   make(chan *reloadReq),
+		redeploys: make(chan *redeployReq),
+		conf:      c,
+	}
+	var err error
+	if s.log, err = newLogger(os.Stderr, c.LogFormat, c.LogLevel); err != nil {
+		s.log = newStdLogger()
+		s.log.Errorf("[server] %s, using default logger", err)
 	}
-	s.regexBranch = regexp.MustCompile(c.BranchRegexp)
+	if c.regexBranch == nil {
+		c.regexBranch = regexp.MustCompile(c.BranchRegexp)
+	}
+	s.warnConfig(c)
 	if c.LimitBuilds > 0 {
 		s.limitBuilds = make(chan struct{}, c.LimitBuilds)
 		for i := 0; i < c.LimitBuilds; i++ {
 			s.limitBuilds <- struct{}{}
 		}
 	}
-	var err error
 	if c.Database != "" && c.Table != "" {
 		if s.storage, err = store.NewMysql(c.Database, c.Table); err != nil {
-			s.log.Printf("[error] cannot start database storage: %s", err)
+			s.log.Errorf("[server] cannot start database storage: %s", err)
 		}
 	}
 	if s.storage == nil {
-		s.log.Printf("[info] no database configured, using memory storage")
+		s.log.Printf("[server] no database configured, using memory storage")
 		s.storage = store.NewMemory()
 	}
+	var states store.StateStore
+	if c.StateFile != "" {
+		states = store.NewFile(c.StateFile)
+	} else if st, ok := s.storage.(store.StateStore); ok {
+		states = st
+	} else {
+		s.log.Printf("[server] no state file configured, stages will not survive a restart")
+	}
+	s.states = newStageStates(states, s.log)
+	if s.queue, err = newNotifQueue(c.QueueSize, c.QueueJournal, s.log); err != nil {
+		s.log.Errorf("[server] %s, queued notifications will not survive a restart", err)
+		s.queue, _ = newNotifQueue(c.QueueSize, "", s.log)
+	}
 	s.urls = newUrls()
+	s.lives = newLiveLogs()
+	s.metrics = newMetrics()
+	s.statuses = make(chan *commitStatus, statusQueueSize)
+	go s.statusReporter(notifyClient)
 	if c.ResultsDuration > 0 && c.ResultsCleanup > 0 {
 		s.cleanup = make(chan struct{})
 		go s.cleaner(s.cleanup, time.Duration(c.ResultsCleanup))
@@ -90,20 +166,43 @@ func (s *server) ServeReqs() {
 	bots := makeMergebots()
 	pros := newProjects(s, bots)
 
-	for n := range s.notifs {
-		s.handleNotif(n, bots, pros)
-		if s.cleanup != nil {
-			s.cleanup <- struct{}{}
+	for {
+		select {
+		case n := <-s.queue.ch:
+			s.handleNotif(n, bots, pros)
+			if s.cleanup != nil {
+				s.cleanup <- struct{}{}
+			}
+		case req := <-s.reloads:
+			s.applyConfig(req.conf, bots, pros)
+			req.done()
+		case req := <-s.redeploys:
+			pros.redeploy(req)
 		}
 	}
 }
 
+// config returns the current configuration, that must not be modified.
+func (s *server) config() *config {
+	s.confMux.RLock()
+	defer s.confMux.RUnlock()
+
+	return s.conf
+}
+
+func (s *server) setConfig(c *config) {
+	s.confMux.Lock()
+	defer s.confMux.Unlock()
+
+	s.conf = c
+}
+
 func (s *server) cleaner(wakeup <-chan struct{}, duration time.Duration) {
 	for range wakeup {
 		before := time.Now().Add(-duration)
-		s.log.Printf("[server] results cleaner: cleaning jobs before %s", before.Format("2006-02-01 15:04:05"))
+		s.log.Printf("[server] results cleaner: cleaning jobs before %s", before.Format("2006-01-02 15:04:05"))
 		if err := s.storage.Clean(before); err != nil {
-			s.log.Printf("[error] results cleaner: %s", err)
+			s.log.Errorf("[server] results cleaner: %s", err)
 		}
 	}
 }
@@ -120,25 +219,55 @@ func (s *server) stopBuild() {
 	}
 }
 
-func (s *server) handleNotif(n *notif, bots mergebots, pros *projects) {
-	s.log.Printf("[server] %s: handling notification", n)
-	bs, err := newBuilds(n, s)
-	if err != nil {
-		s.log.Printf("[server] %s: no builds created: %s", n, err)
-		return
-	}
-	bot := bots.get(n.project)
-	if bot == nil {
-		s.log.Printf("[server] no mergebot found for %s, skipping build push", n.project)
-		return
+func (s *server) isStatic(project, branch string) bool {
+	for _, b := range s.config().Envs[project].Statics {
+		if b == branch {
+			return true
+		}
 	}
+	return false
+}
+
+// handleNotif passes a notification to its builds. The notification
+// is done in the queue when all the builds are done.
+func (s *server) handleNotif(n *notif, bots mergebots, pros *projects) {
+	bs, bot := s.notifBuilds(n, bots)
+	ack := s.queue.acker(n.id, len(bs))
 	for _, b := range bs {
 		switch n.ntype {
 		case notifPush:
-			pros.push(b, n, bot)
+			pros.push(b, n, bot, ack)
 		case notifDelete:
-			pros.destroy(b, n, -1)
+			pros.destroy(b, n, -1, ack)
 			bot.destroy(b.stage)
 		}
 	}
 }
+
+// notifBuilds returns the builds to run for a notification.
+func (s *server) notifBuilds(n *notif, bots mergebots) ([]*build, *mergebot) {
+	log := n.logger(s.log)
+	log.Printf("[server] handling notification")
+	// Notifications can name any project, keep the labels bounded
+	project := n.project
+	if _, ok := s.config().Envs[project]; !ok {
+		project = "unknown"
+	}
+	s.metrics.notifs.inc(project, n.ntype.String())
+	// Static environments are never removed automatically
+	if n.removed && s.isStatic(n.project, n.branch) {
+		log.Printf("[server] static branch deleted upstream, keeping its stages")
+		return nil, nil
+	}
+	bs, err := newBuilds(n, s)
+	if err != nil {
+		log.Errorf("[server] no builds created: %s", err)
+		return nil, nil
+	}
+	bot := bots.get(n.project)
+	if bot == nil {
+		log.Errorf("[server] no mergebot found, skipping build push")
+		return nil, nil
+	}
+	return bs, bot
+}
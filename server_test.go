@@ -0,0 +1,87 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns a configuration running cmds for projects, that
+// deploy each ticket to its own stage.
+func newTestConfig(cmds commandsConfig, projects ...string) *config {
+	c := &config{
+		BranchRegexp:   `^(?:[A-Z0-9]+\-)?(\d+)\-`,
+		LogLevel:       "error",
+		CommandTimeout: duration(time.Minute),
+		Commands:       cmds,
+		Envs:           make(map[string]envConfig),
+	}
+	for _, p := range projects {
+		c.Envs[p] = envConfig{Branches: map[string][]string{"__default__": {"{ENV}.ticket{TICKET}"}}}
+	}
+	c.regexBranch = regexp.MustCompile(c.BranchRegexp)
+	return c
+}
+
+// waitFor fails the test if cond does not become true in a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func waitStage(t *testing.T, s *server, stage string) {
+	t.Helper()
+	waitFor(t, "stage "+stage+" deployed", func() bool {
+		_, ok := s.states.get(stage)
+		return ok
+	})
+}
+
+func TestNotifZeroSHA1IsDelete(t *testing.T) {
+	n := newNotif("projectNemo", zeroSHA1, "NEMO-123-login", notifPush)
+	if n.ntype != notifDelete || !n.removed {
+		t.Error("expected push of zero SHA1 to be a delete notification")
+	}
+	if n.sha1 != "" {
+		t.Errorf("expected empty SHA1 for deleted branch, got %s", n.sha1)
+	}
+	n = newNotif("projectNemo", "0ff715f31f275dcdc16762ae9e80c0afbb6c1be0", "NEMO-123-login", notifPush)
+	if n.ntype != notifPush || n.removed {
+		t.Error("expected normal push notification")
+	}
+}
+
+func TestSlowStageDoesNotBlock(t *testing.T) {
+	s := NewServer(newTestConfig(commandsConfig{
+		CmdCreate: []string{"sh", "-c", "case {STAGE} in *ticket12) sleep 10;; esac; echo create {STAGE}"},
+	}, "projectNemo"))
+	go s.ServeReqs()
+
+	for _, branch := range []string{"NEMO-12-slow", "NEMO-13-test", "NEMO-14-test"} {
+		if _, err := s.enqueue(newNotif("projectNemo", "0ff715f", branch, notifPush)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The other stages are deployed while the first one is still running
+	for _, stage := range []string{"projectNemo.ticket13", "projectNemo.ticket14"} {
+		waitFor(t, stage+" deployed", func() bool {
+			brs, _ := s.storage.Get(stage)
+			return len(brs) == 1
+		})
+	}
+	if brs, _ := s.storage.Get("projectNemo.ticket12"); len(brs) != 0 {
+		t.Errorf("expected slow build still running, got %d results", len(brs))
+	}
+	if len(s.queue.ch) != 0 {
+		t.Errorf("expected all notifications taken from the queue, %d left", len(s.queue.ch))
+	}
+}
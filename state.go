@@ -0,0 +1,136 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+// stageState is what is needed to recreate a live stage after a restart.
+type stageState struct {
+	Project string `json:"project"`
+	Stage   string `json:"stage"`
+	Branch  string `json:"branch"`
+	SHA1    string `json:"sha1"` // last pushed revision, also tracked by mergebot
+	Ticket  int64  `json:"ticket"`
+	Token   int64  `json:"token"`
+	URL     string `json:"url"`
+}
+
+// stageStates keeps a snapshot of all live stages and saves it
+// at every change. A nil store disables persistence.
+type stageStates struct {
+	mux     sync.Mutex
+	entries map[string]*stageState // stage : state
+	store   store.StateStore
+	log     logger
+}
+
+func newStageStates(st store.StateStore, log logger) *stageStates {
+	return &stageStates{
+		entries: make(map[string]*stageState),
+		store:   st,
+		log:     log,
+	}
+}
+
+// load reads back the saved snapshot.
+func (s *stageStates) load() []*stageState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.store == nil {
+		return nil
+	}
+	data, err := s.store.LoadState()
+	if err == store.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		s.log.Errorf("[state] cannot load saved state: %s", err)
+		return nil
+	}
+	var sts []*stageState
+	if err := json.Unmarshal(data, &sts); err != nil {
+		s.log.Errorf("[state] cannot decode saved state: %s", err)
+		return nil
+	}
+	for _, st := range sts {
+		s.entries[st.Stage] = st
+	}
+	return sts
+}
+
+// get returns a copy of the state of a stage.
+func (s *stageStates) get(stage string) (stageState, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	st, ok := s.entries[stage]
+	if !ok {
+		return stageState{}, false
+	}
+	return *st, true
+}
+
+// list returns a copy of all states sorted by project and stage.
+func (s *stageStates) list() []stageState {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	sts := make([]stageState, 0, len(s.entries))
+	for _, st := range s.entries {
+		sts = append(sts, *st)
+	}
+	sort.Slice(sts, func(i, j int) bool {
+		if sts[i].Project != sts[j].Project {
+			return sts[i].Project < sts[j].Project
+		}
+		return sts[i].Stage < sts[j].Stage
+	})
+	return sts
+}
+
+func (s *stageStates) set(st *stageState) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.entries[st.Stage] = st
+	s.save()
+}
+
+func (s *stageStates) del(stage string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if _, ok := s.entries[stage]; !ok {
+		return
+	}
+	delete(s.entries, stage)
+	s.save()
+}
+
+// save must be called with the lock held.
+func (s *stageStates) save() {
+	if s.store == nil {
+		return
+	}
+	sts := make([]*stageState, 0, len(s.entries))
+	for _, st := range s.entries {
+		sts = append(sts, st)
+	}
+	data, err := json.Marshal(sts)
+	if err != nil {
+		s.log.Errorf("[state] cannot encode state: %s", err)
+		return
+	}
+	if err := s.store.SaveState(data); err != nil {
+		s.log.Errorf("[state] cannot save state: %s", err)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestStageStatesRoundtrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "umarell")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "state.json")
+
+	sts := newStageStates(store.NewFile(fname), newStdLogger())
+	if loaded := sts.load(); len(loaded) != 0 {
+		t.Fatalf("expected empty state, got %d entries", len(loaded))
+	}
+	sts.set(&stageState{Project: "projectNemo", Stage: "projectNemo.ticket12", Branch: "NEMO-12-test", Token: 3})
+	sts.set(&stageState{Project: "projectNemo", Stage: "projectNemo.ticket13", Branch: "NEMO-13-test", Token: 1})
+	sts.del("projectNemo.ticket13")
+
+	loaded := newStageStates(store.NewFile(fname), newStdLogger()).load()
+	if len(loaded) != 1 {
+		t.Fatalf("expected one stage, got %d", len(loaded))
+	}
+	if st := loaded[0]; st.Stage != "projectNemo.ticket12" || st.Token != 3 {
+		t.Errorf("unexpected restored stage %+v", st)
+	}
+}
@@ -0,0 +1,223 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Commit statuses waiting to be sent; more are dropped
+const statusQueueSize = 100
+
+type statusConfig struct {
+	// github, gitlab or gitea
+	Forge string `json:"forge"`
+	// Base URL of the API, required for gitea and self-hosted gitlab
+	APIURL string `json:"api_url"`
+	Token  string `json:"token"`
+	// Name of the status, can use the same placeholders as commands
+	Context string `json:"context"`
+}
+
+var defaultAPIURLs = map[string]string{
+	"github": "https://api.github.com",
+	"gitlab": "https://gitlab.com",
+}
+
+func (c *statusConfig) check(errs *configErrors, path string, repo string) {
+	switch c.Forge {
+	case "github", "gitlab":
+	case "gitea":
+		if c.APIURL == "" {
+			errs.add(path+".api_url", "required for gitea")
+		}
+	default:
+		errs.add(path+".forge", "unknown forge %q, use github, gitlab or gitea", c.Forge)
+	}
+	if c.Token == "" {
+		errs.add(path+".token", "required to report commit statuses")
+	}
+	if repo == "" {
+		errs.add(path, "the project must set repository to report commit statuses")
+	}
+	checkPlaceholders(errs, path+".context", []string{c.Context}, commandPlaceholders)
+}
+
+type statusState int
+
+const (
+	statusPending statusState = iota
+	statusSuccess
+	statusFailure
+	statusSkipped
+	statusCancelled
+)
+
+// name returns the state as called by the forge.
+func (s statusState) name(forge string) string {
+	switch s {
+	case statusPending:
+		return "pending"
+	case statusSuccess:
+		return "success"
+	case statusSkipped:
+		// The commit was not deployed, the others have no state for it
+		if forge == "gitlab" {
+			return "skipped"
+		}
+		return "error"
+	case statusCancelled:
+		if forge == "gitlab" {
+			return "canceled"
+		}
+		return "error"
+	}
+	if forge == "gitlab" {
+		return "failed"
+	}
+	return "failure"
+}
+
+type commitStatus struct {
+	conf        statusConfig
+	repo        string
+	sha1        string
+	state       statusState
+	context     string
+	description string
+	targetURL   string
+}
+
+// repoPath returns the owner/name path of a repository that can also be given as URL.
+func repoPath(repo string) string {
+	if u, err := url.Parse(repo); err == nil && u.Host != "" {
+		repo = u.Path
+	} else if i := strings.IndexByte(repo, ':'); i >= 0 && strings.Contains(repo[:i], "@") {
+		// SSH form, as in git@github.com:acme/nemo.git
+		repo = repo[i+1:]
+	}
+	return strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+}
+
+// request returns the API request that sets the status.
+func (st *commitStatus) request() (*http.Request, error) {
+	c := &st.conf
+	api := c.APIURL
+	if api == "" {
+		api = defaultAPIURLs[c.Forge]
+	}
+	api = strings.TrimSuffix(api, "/")
+	repo := repoPath(st.repo)
+	body := map[string]string{
+		"state":       st.state.name(c.Forge),
+		"target_url":  st.targetURL,
+		"description": st.description,
+	}
+	var endpoint string
+	switch c.Forge {
+	case "github":
+		endpoint = fmt.Sprintf("%s/repos/%s/statuses/%s", api, repo, st.sha1)
+		body["context"] = st.context
+	case "gitea":
+		endpoint = fmt.Sprintf("%s/api/v1/repos/%s/statuses/%s", api, repo, st.sha1)
+		body["context"] = st.context
+	case "gitlab":
+		endpoint = fmt.Sprintf("%s/api/v4/projects/%s/statuses/%s", api, url.PathEscape(repo), st.sha1)
+		body["name"] = st.context
+	default:
+		return nil, fmt.Errorf("unknown forge %s", c.Forge)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Forge == "gitlab" {
+		req.Header.Set("PRIVATE-TOKEN", c.Token)
+	} else {
+		req.Header.Set("Authorization", "token "+c.Token)
+	}
+	return req, nil
+}
+
+func (st *commitStatus) send(client *http.Client) error {
+	req, err := st.request()
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("POST %s: unexpected status %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// newCommitStatus returns the status for a build request or nil if
+// the project does not report statuses.
+func (b *build) newCommitStatus(req *buildReq, state statusState, description, path string) *commitStatus {
+	conf := b.srv.config()
+	env := conf.Envs[b.project]
+	if env.Status == nil || req.notif.sha1 == "" {
+		return nil
+	}
+	st := &commitStatus{
+		conf:        *env.Status,
+		repo:        env.Repository,
+		sha1:        req.notif.sha1,
+		state:       state,
+		context:     "umarell/" + b.stage,
+		description: description,
+	}
+	if env.Status.Context != "" {
+		st.context = b.cmdVars(req.notif.branch).applySingle(env.Status.Context)
+	}
+	if conf.PublicURL != "" {
+		st.targetURL = strings.TrimSuffix(conf.PublicURL, "/") + path
+	}
+	return st
+}
+
+// livePath returns the path of the page following the running build.
+func (b *build) livePath() string {
+	return fmt.Sprintf("/%s/stages/%s/live", url.PathEscape(b.project), url.PathEscape(b.stage))
+}
+
+// outputPath returns the path of the output of a finished build.
+func (b *build) outputPath(id int64, stream string) string {
+	return fmt.Sprintf("/%s/stages/%s/builds/%d/%s", url.PathEscape(b.project), url.PathEscape(b.stage), id, stream)
+}
+
+// reportStatus queues a commit status to be sent in order with the previous ones.
+func (s *server) reportStatus(st *commitStatus) {
+	if st == nil {
+		return
+	}
+	select {
+	case s.statuses <- st:
+	default:
+		s.log.Errorf("[status] too many commit statuses queued, dropping %s for %s", st.state.name(st.conf.Forge), st.sha1)
+	}
+}
+
+func (s *server) statusReporter(client *http.Client) {
+	for st := range s.statuses {
+		if err := st.send(client); err != nil {
+			s.log.with("sha1", st.sha1).Errorf("[status] cannot report commit status %s: %s", st.context, err)
+		}
+	}
+}
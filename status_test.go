@@ -0,0 +1,109 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/dullgiulio/umarell/store"
+)
+
+func TestRepoPath(t *testing.T) {
+	for _, repo := range []string{"acme/nemo", "https://github.com/acme/nemo.git", "git@github.com:acme/nemo.git", "/acme/nemo/"} {
+		if p := repoPath(repo); p != "acme/nemo" {
+			t.Errorf("%s: unexpected path %s", repo, p)
+		}
+	}
+}
+
+func TestCommitStatusForges(t *testing.T) {
+	type received struct {
+		path, auth string
+		body       map[string]string
+	}
+	reqs := make(chan received, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		auth := r.Header.Get("Authorization")
+		if auth == "" {
+			auth = r.Header.Get("PRIVATE-TOKEN")
+		}
+		reqs <- received{r.URL.EscapedPath(), auth, body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		forge, path, auth, state, context string
+	}{
+		{"github", "/repos/acme/nemo/statuses/0ff715f", "token SECRET", "failure", "context"},
+		{"gitea", "/api/v1/repos/acme/nemo/statuses/0ff715f", "token SECRET", "failure", "context"},
+		{"gitlab", "/api/v4/projects/acme%2Fnemo/statuses/0ff715f", "SECRET", "failed", "name"},
+	}
+	for _, tt := range tests {
+		st := &commitStatus{
+			conf:        statusConfig{Forge: tt.forge, APIURL: ts.URL + "/", Token: "SECRET"},
+			repo:        "acme/nemo",
+			sha1:        "0ff715f",
+			state:       statusFailure,
+			context:     "umarell/nemo.ticket12",
+			description: "create failed",
+			targetURL:   "https://umarell.example.test/nemo/stages/nemo.ticket12/live",
+		}
+		if err := st.send(ts.Client()); err != nil {
+			t.Fatalf("%s: %s", tt.forge, err)
+		}
+		r := <-reqs
+		if r.path != tt.path || r.auth != tt.auth {
+			t.Errorf("%s: unexpected request to %s with auth %s", tt.forge, r.path, r.auth)
+		}
+		if r.body["state"] != tt.state || r.body[tt.context] != st.context || r.body["target_url"] != st.targetURL {
+			t.Errorf("%s: unexpected body %v", tt.forge, r.body)
+		}
+	}
+}
+
+func TestCommitStatusBranch(t *testing.T) {
+	s := &server{
+		conf: &config{
+			regexBranch: regexp.MustCompile(`^(?:[A-Z0-9]+\-)?(\d+)\-`),
+			Envs: map[string]envConfig{
+				"projectNemo": {
+					Branches: map[string][]string{"__default__": {"{ENV}.ticket{TICKET}"}},
+					Status:   &statusConfig{Forge: "github", Context: "ci/{BRANCH}"},
+				},
+			},
+		},
+		log: discardLogger,
+	}
+	bs, err := newBuilds(newNotif("projectNemo", "0ff715f", "NEMO-12-b0", notifPush), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pending status of a change is for the branch it deploys
+	req := newBuildReq(store.BuildActChange, newNotif("projectNemo", "5ea4a1b", "NEMO-12-b1", notifPush), 2, nil)
+	st := bs[0].newCommitStatus(req, statusPending, "queued", bs[0].livePath())
+	if st.context != "ci/NEMO-12-b1" || st.sha1 != "5ea4a1b" {
+		t.Errorf("unexpected status %s for %s", st.context, st.sha1)
+	}
+}
+
+func TestStatusStateName(t *testing.T) {
+	// Commits that were not deployed are never reported as successful
+	for _, state := range []statusState{statusSkipped, statusCancelled} {
+		for _, forge := range []string{"github", "gitea", "gitlab"} {
+			if name := state.name(forge); name == "success" {
+				t.Errorf("%s: state %d reported as %s", forge, state, name)
+			}
+		}
+	}
+}
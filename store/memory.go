@@ -6,15 +6,17 @@ package store
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
-var errNotFound = errors.New("not found")
+var ErrNotFound = errors.New("not found")
 
 type Memory struct {
-	mux  sync.RWMutex
-	data map[string][]*BuildResult // stage : buildResults
+	mux    sync.RWMutex
+	lastID int64
+	data   map[string][]*BuildResult // stage : buildResults
 }
 
 func NewMemory() *Memory {
@@ -30,6 +32,8 @@ func (b *Memory) Add(br *BuildResult) error {
 	if _, ok := b.data[br.Stage]; !ok {
 		b.data[br.Stage] = make([]*BuildResult, 0)
 	}
+	b.lastID++
+	br.ID = b.lastID
 	b.data[br.Stage] = append(b.data[br.Stage], br)
 	return nil
 }
@@ -39,11 +43,74 @@ func (b *Memory) Get(stage string) ([]*BuildResult, error) {
 	defer b.mux.RUnlock()
 
 	if _, ok := b.data[stage]; !ok {
-		return nil, errNotFound
+		return nil, ErrNotFound
 	}
 	return b.data[stage], nil
 }
 
+type byStartDesc []*BuildResult
+
+func (b byStartDesc) Len() int      { return len(b) }
+func (b byStartDesc) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byStartDesc) Less(i, j int) bool {
+	if b[i].Start.Equal(b[j].Start) {
+		return b[i].ID > b[j].ID
+	}
+	return b[i].Start.After(b[j].Start)
+}
+
+func (b *Memory) List(stage string, offset, limit int) ([]*BuildResult, error) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	data, ok := b.data[stage]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	brs := make([]*BuildResult, len(data))
+	for i := range data {
+		// Copy without the output, like the database would
+		br := *data[i]
+		br.Stdout = nil
+		br.Stderr = nil
+		brs[i] = &br
+	}
+	sort.Sort(byStartDesc(brs))
+	if offset >= len(brs) {
+		return []*BuildResult{}, nil
+	}
+	brs = brs[offset:]
+	if limit > 0 && limit < len(brs) {
+		brs = brs[:limit]
+	}
+	return brs, nil
+}
+
+func (b *Memory) Result(id int64) (*BuildResult, error) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	for _, brs := range b.data {
+		for _, br := range brs {
+			if br.ID == id {
+				return br, nil
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (b *Memory) Stages() ([]string, error) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+
+	stages := make([]string, 0, len(b.data))
+	for stage := range b.data {
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
 func (b *Memory) Delete(stage string) error {
 	b.mux.Lock()
 	defer b.mux.Unlock()
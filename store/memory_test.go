@@ -0,0 +1,57 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryList(t *testing.T) {
+	m := NewMemory()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		m.Add(&BuildResult{
+			Stage:  "test.ticket1",
+			Start:  now.Add(time.Duration(i) * time.Minute),
+			Stdout: []byte("output"),
+		})
+	}
+	brs, err := m.List("test.ticket1", 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(brs) != 2 {
+		t.Fatalf("expected two results, got %d", len(brs))
+	}
+	if brs[0].ID != 4 || brs[1].ID != 3 {
+		t.Errorf("expected results 4 and 3, got %d and %d", brs[0].ID, brs[1].ID)
+	}
+	if brs[0].Stdout != nil {
+		t.Error("expected listed result without output")
+	}
+	br, err := m.Result(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(br.Stdout) != "output" {
+		t.Error("expected full result to include output")
+	}
+	if _, err := m.List("unknown", 0, 0); err != ErrNotFound {
+		t.Errorf("expected not found error, got %v", err)
+	}
+}
+
+func TestBuildResultTimes(t *testing.T) {
+	now := time.Now()
+	br := &BuildResult{Queued: now, Start: now.Add(time.Second), End: now.Add(time.Minute)}
+	if br.Wait() != time.Second || br.Duration() != 59*time.Second {
+		t.Errorf("unexpected wait %s and duration %s", br.Wait(), br.Duration())
+	}
+	br.Queued = time.Time{}
+	if br.Wait() != 0 {
+		t.Errorf("expected no wait without queue time, got %s", br.Wait())
+	}
+}
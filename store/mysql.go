@@ -6,39 +6,102 @@ package store
 
 import (
 	"database/sql"
-	"errors"
 	"fmt"
 	"sync"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
 const createTable = `
-CREATE TABLE IF NOT EXISTS build_results (
+CREATE TABLE IF NOT EXISTS %s (
   id int(11) NOT NULL AUTO_INCREMENT,
+  queued datetime NULL,
   start datetime NOT NULL,
   end datetime NOT NULL,
   act int(11) NOT NULL,
   ticket int(11) NOT NULL,
   exitcode int(11) NOT NULL,
+  status int(11) NOT NULL DEFAULT 0,
   sha1 char(40) NOT NULL,
+  project varchar(250) NOT NULL DEFAULT '',
   stage varchar(250) NOT NULL,
   cmd text NOT NULL,
   branch text NOT NULL,
+  source int(11) NOT NULL DEFAULT 0,
+  username varchar(250) NOT NULL DEFAULT '',
+  token bigint(20) NOT NULL DEFAULT 0,
   stdout text NOT NULL,
   stderr text NOT NULL,
+  PRIMARY KEY (id),
+  KEY stage_start (stage, start)
+);
+`
+
+const createStateTable = `
+CREATE TABLE IF NOT EXISTS %s_state (
+  id int(11) NOT NULL,
+  updated datetime NOT NULL,
+  data mediumtext NOT NULL,
   PRIMARY KEY (id)
 );
 `
 
 const (
-	queryAdd         = `INSERT INTO %s (start,end,act,ticket,exitcode,sha1,stage,cmd,branch,stdout,stderr) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	queryAdd         = `INSERT INTO %s (queued,start,end,act,ticket,exitcode,status,sha1,project,stage,cmd,branch,source,username,token,stdout,stderr) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	queryDeleteStage = `DELETE FROM %s WHERE stage = ?`
 	queryDeleteClean = `DELETE FROM %s WHERE end < ?`
-	// queryGet = TODO
+	queryGet         = `SELECT id,queued,start,end,act,ticket,exitcode,status,sha1,project,stage,cmd,branch,source,username,token,stdout,stderr FROM %s WHERE stage = ? ORDER BY start, id`
+	queryList        = `SELECT id,queued,start,end,act,ticket,exitcode,status,sha1,project,stage,cmd,branch,source,username,token,'','' FROM %s WHERE stage = ? ORDER BY start DESC, id DESC LIMIT ? OFFSET ?`
+	queryResult      = `SELECT id,queued,start,end,act,ticket,exitcode,status,sha1,project,stage,cmd,branch,source,username,token,stdout,stderr FROM %s WHERE id = ?`
+	queryStages      = `SELECT DISTINCT stage FROM %s`
+	querySaveState   = `REPLACE INTO %s_state (id,updated,data) VALUES (1, ?, ?)`
+	queryLoadState   = `SELECT data FROM %s_state WHERE id = 1`
 )
 
+const queryHasColumn = `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`
+
+// column is added to tables created by older versions, then the
+// queries in fill set its value for the existing rows.
+type column struct {
+	name string
+	add  string
+	fill []string
+}
+
+var migrations = []column{
+	{
+		name: "status",
+		add:  `ALTER TABLE %s ADD COLUMN status int(11) NOT NULL DEFAULT 0 AFTER exitcode`,
+		fill: []string{`UPDATE %s SET status = 1 WHERE exitcode <> 0`},
+	},
+	{
+		name: "queued",
+		add:  `ALTER TABLE %s ADD COLUMN queued datetime NULL AFTER id`,
+		// Unknown, assume the builds did not wait
+		fill: []string{`UPDATE %s SET queued = start`},
+	},
+	{
+		name: "project",
+		add:  `ALTER TABLE %s ADD COLUMN project varchar(250) NOT NULL DEFAULT '' AFTER sha1`,
+	},
+	{
+		name: "source",
+		add:  `ALTER TABLE %s ADD COLUMN source int(11) NOT NULL DEFAULT 0 AFTER branch`,
+	},
+	{
+		name: "username",
+		add:  `ALTER TABLE %s ADD COLUMN username varchar(250) NOT NULL DEFAULT '' AFTER source`,
+	},
+	{
+		name: "token",
+		add:  `ALTER TABLE %s ADD COLUMN token bigint(20) NOT NULL DEFAULT 0 AFTER username`,
+	},
+}
+
+// Upper bound for LIMIT when listing without a limit.
+const maxRows = 1<<63 - 1
+
 type Mysql struct {
 	mux          sync.Mutex
 	db           *sql.DB
@@ -46,6 +109,12 @@ type Mysql struct {
 	stmtAdd      string
 	stmtDelStage string
 	stmtDelClean string
+	stmtGet      string
+	stmtList     string
+	stmtResult   string
+	stmtStages   string
+	stmtSave     string
+	stmtLoad     string
 }
 
 func NewMysql(dsn, tableName string) (*Mysql, error) {
@@ -64,41 +133,191 @@ func (m *Mysql) initStmts() error {
 	var err error
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	if _, err = m.db.Exec(createTable); err != nil {
+	if _, err = m.db.Exec(fmt.Sprintf(createTable, m.tableName)); err != nil {
 		return fmt.Errorf("cannot create storage table: %s", err)
 	}
+	if _, err = m.db.Exec(fmt.Sprintf(createStateTable, m.tableName)); err != nil {
+		return fmt.Errorf("cannot create state table: %s", err)
+	}
+	if err = m.migrate(); err != nil {
+		return fmt.Errorf("cannot migrate storage table: %s", err)
+	}
 	m.stmtAdd = fmt.Sprintf(queryAdd, m.tableName)
 	m.stmtDelStage = fmt.Sprintf(queryDeleteStage, m.tableName)
 	m.stmtDelClean = fmt.Sprintf(queryDeleteClean, m.tableName)
+	m.stmtGet = fmt.Sprintf(queryGet, m.tableName)
+	m.stmtList = fmt.Sprintf(queryList, m.tableName)
+	m.stmtResult = fmt.Sprintf(queryResult, m.tableName)
+	m.stmtStages = fmt.Sprintf(queryStages, m.tableName)
+	m.stmtSave = fmt.Sprintf(querySaveState, m.tableName)
+	m.stmtLoad = fmt.Sprintf(queryLoadState, m.tableName)
+	return nil
+}
+
+// migrate adds the columns missing in the storage table. Must be called with the lock held.
+func (m *Mysql) migrate() error {
+	for _, c := range migrations {
+		var n int
+		if err := m.db.QueryRow(queryHasColumn, m.tableName, c.name).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+		if _, err := m.db.Exec(fmt.Sprintf(c.add, m.tableName)); err != nil {
+			return fmt.Errorf("cannot add column %s: %s", c.name, err)
+		}
+		for _, q := range c.fill {
+			if _, err := m.db.Exec(fmt.Sprintf(q, m.tableName)); err != nil {
+				return fmt.Errorf("cannot fill column %s: %s", c.name, err)
+			}
+		}
+	}
 	return nil
 }
 
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanResult reads a row in the column order used by the SELECT queries.
+// Dates are scanned through the driver so that parseTime is not required in the DSN.
+func scanResult(s scanner) (*BuildResult, error) {
+	var (
+		br                 BuildResult
+		queued, start, end mysql.NullTime
+	)
+	if err := s.Scan(&br.ID, &queued, &start, &end, &br.Act, &br.Ticket, &br.Retval, &br.Status, &br.SHA1,
+		&br.Project, &br.Stage, &br.Cmd, &br.Branch, &br.Trigger, &br.User, &br.Token, &br.Stdout, &br.Stderr); err != nil {
+		return nil, err
+	}
+	br.Queued = queued.Time
+	br.Start = start.Time
+	br.End = end.Time
+	return &br, nil
+}
+
+func (m *Mysql) query(stmt string, args ...interface{}) ([]*BuildResult, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	rows, err := m.db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	brs := make([]*BuildResult, 0)
+	for rows.Next() {
+		br, err := scanResult(rows)
+		if err != nil {
+			return nil, err
+		}
+		brs = append(brs, br)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return brs, nil
+}
+
 func (m *Mysql) Add(br *BuildResult) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	r, err := m.db.Query(m.stmtAdd, br.Start, br.End, br.Act, br.Ticket, br.Retval, br.SHA1,
-		br.Stage, br.Cmd, br.Branch, br.Stdout, br.Stderr)
-	r.Close()
+	var queued interface{}
+	if !br.Queued.IsZero() {
+		queued = br.Queued
+	}
+	r, err := m.db.Exec(m.stmtAdd, queued, br.Start, br.End, br.Act, br.Ticket, br.Retval, br.Status, br.SHA1,
+		br.Project, br.Stage, br.Cmd, br.Branch, br.Trigger, br.User, br.Token, br.Stdout, br.Stderr)
+	if err != nil {
+		return err
+	}
+	br.ID, err = r.LastInsertId()
 	return err
 }
 
 func (m *Mysql) Get(stage string) ([]*BuildResult, error) {
-	// TODO
-	return nil, errors.New("not implemented")
+	brs, err := m.query(m.stmtGet, stage)
+	if err != nil {
+		return nil, err
+	}
+	if len(brs) == 0 {
+		return nil, ErrNotFound
+	}
+	return brs, nil
+}
+
+func (m *Mysql) List(stage string, offset, limit int) ([]*BuildResult, error) {
+	var lim int64 = maxRows
+	if limit > 0 {
+		lim = int64(limit)
+	}
+	brs, err := m.query(m.stmtList, stage, lim, offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(brs) == 0 && offset == 0 {
+		return nil, ErrNotFound
+	}
+	return brs, nil
+}
+
+func (m *Mysql) Result(id int64) (*BuildResult, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	br, err := scanResult(m.db.QueryRow(m.stmtResult, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return br, err
+}
+
+func (m *Mysql) Stages() ([]string, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	rows, err := m.db.Query(m.stmtStages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stages := make([]string, 0)
+	for rows.Next() {
+		var stage string
+		if err := rows.Scan(&stage); err != nil {
+			return nil, err
+		}
+		stages = append(stages, stage)
+	}
+	return stages, rows.Err()
 }
 
 func (m *Mysql) Delete(stage string) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	r, err := m.db.Query(m.stmtDelStage, stage)
-	r.Close()
+	_, err := m.db.Exec(m.stmtDelStage, stage)
 	return err
 }
 
 func (m *Mysql) Clean(until time.Time) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
-	r, err := m.db.Query(m.stmtDelClean, until)
-	r.Close()
+	_, err := m.db.Exec(m.stmtDelClean, until)
 	return err
 }
+
+func (m *Mysql) SaveState(data []byte) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	_, err := m.db.Exec(m.stmtSave, time.Now(), data)
+	return err
+}
+
+func (m *Mysql) LoadState() ([]byte, error) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	var data []byte
+	err := m.db.QueryRow(m.stmtLoad).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
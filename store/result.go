@@ -7,26 +7,117 @@ package store
 import "time"
 
 type BuildResult struct {
-	Start  time.Time
-	End    time.Time
-	Act    BuildAct
-	Stdout []byte
-	Stderr []byte
-	Retval int
-	Ticket int64
-	Cmd    string
-	Stage  string
-	Branch string
-	SHA1   string
+	ID      int64
+	Queued  time.Time // when the notification was received
+	Start   time.Time
+	End     time.Time
+	Act     BuildAct
+	Stdout  []byte
+	Stderr  []byte
+	Retval  int // -1 if the command did not start or was killed
+	Status  BuildStatus
+	Ticket  int64
+	Cmd     string
+	Project string
+	Stage   string
+	Branch  string
+	SHA1    string
+	Trigger BuildTrigger
+	User    string // who triggered the build, if known
+	Token   int64  // deployment number of the stage
+}
+
+// Duration returns how long the command ran.
+func (br *BuildResult) Duration() time.Duration {
+	return br.End.Sub(br.Start)
+}
+
+// Wait returns how long the build waited before running.
+func (br *BuildResult) Wait() time.Duration {
+	if br.Queued.IsZero() || br.Queued.After(br.Start) {
+		return 0
+	}
+	return br.Start.Sub(br.Queued)
 }
 
 type Store interface {
 	Add(br *BuildResult) error
 	Get(stage string) ([]*BuildResult, error)
+	// List returns at most limit results for stage, newest first, skipping
+	// the first offset. Stdout and Stderr are not loaded.
+	List(stage string, offset, limit int) ([]*BuildResult, error)
+	// Result returns a single result, including its output.
+	Result(id int64) (*BuildResult, error)
+	// Stages returns the names of all stages with at least one result.
+	Stages() ([]string, error)
 	Delete(stage string) error
 	Clean(until time.Time) error
 }
 
+// BuildStatus is how a build command ended.
+type BuildStatus int
+
+const (
+	BuildStatusSuccess BuildStatus = iota
+	BuildStatusFailed
+	// Stopped as a newer request made it obsolete
+	BuildStatusCancelled
+	// Stopped after command_timeout
+	BuildStatusTimedOut
+	// The command could not be started
+	BuildStatusError
+	// Superseded by a newer request before running
+	BuildStatusSkipped
+)
+
+func (s BuildStatus) String() string {
+	switch s {
+	case BuildStatusSuccess:
+		return "success"
+	case BuildStatusFailed:
+		return "failed"
+	case BuildStatusCancelled:
+		return "cancelled"
+	case BuildStatusTimedOut:
+		return "timeout"
+	case BuildStatusError:
+		return "error"
+	case BuildStatusSkipped:
+		return "skipped"
+	}
+	return "unknown"
+}
+
+// BuildTrigger is what requested a build.
+type BuildTrigger int
+
+const (
+	// Builds stored by older versions
+	BuildTriggerUnknown BuildTrigger = iota
+	// A push notified by a forge webhook
+	BuildTriggerWebhook
+	// A person using the dashboard or the redeploy endpoint
+	BuildTriggerManual
+	// The merge detector found the branch merged
+	BuildTriggerMerge
+	// A call to the notifyCommit or delete endpoints with a token
+	BuildTriggerAPI
+)
+
+func (t BuildTrigger) String() string {
+	switch t {
+	case BuildTriggerWebhook:
+		return "webhook"
+	case BuildTriggerManual:
+		return "manual"
+	case BuildTriggerMerge:
+		return "merge"
+	case BuildTriggerAPI:
+		return "api"
+	}
+	return "unknown"
+}
+
 type BuildAct int
 
 const (
@@ -0,0 +1,52 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StateStore persists an opaque snapshot of the server state.
+type StateStore interface {
+	SaveState(data []byte) error
+	// LoadState returns ErrNotFound if no state was ever saved.
+	LoadState() ([]byte, error)
+}
+
+type File struct {
+	path string
+}
+
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// SaveState writes to a temporary file first, so that a crash never leaves a truncated state.
+func (f *File) SaveState(data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *File) LoadState() ([]byte, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
@@ -8,22 +8,28 @@ import (
 	"sync"
 )
 
+// stageURLs are the links of a live stage.
+type stageURLs struct {
+	URL      string // where the environment is deployed, empty if not configured
+	Redeploy string // path that triggers a new deployment
+}
+
 type urls struct {
-	entries map[string]string // stage : url
+	entries map[string]stageURLs // stage : urls
 	mux     sync.RWMutex
 }
 
 func newUrls() *urls {
 	return &urls{
-		entries: make(map[string]string),
+		entries: make(map[string]stageURLs),
 	}
 }
 
-func (u *urls) get() []string {
+func (u *urls) get() []stageURLs {
 	u.mux.RLock()
 	defer u.mux.RUnlock()
 
-	list := make([]string, len(u.entries))
+	list := make([]stageURLs, len(u.entries))
 	i := 0
 	for _, v := range u.entries {
 		list[i] = v
@@ -32,7 +38,14 @@ func (u *urls) get() []string {
 	return list
 }
 
-func (u *urls) set(k, v string) {
+func (u *urls) lookup(k string) stageURLs {
+	u.mux.RLock()
+	defer u.mux.RUnlock()
+
+	return u.entries[k]
+}
+
+func (u *urls) set(k string, v stageURLs) {
 	u.mux.Lock()
 	defer u.mux.Unlock()
 
@@ -0,0 +1,380 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Placeholders that can be used in stage templates and in commands
+var (
+	stagePlaceholders   = []string{"ENV", "TICKET", "BRANCH"}
+	commandPlaceholders = []string{"ENV", "TICKET", "BRANCH", "STAGE"}
+)
+
+// Placeholders preceded by $ are for the shell, as in ${HOME}
+var placeholderRegexp = regexp.MustCompile(`\{[A-Z_]+\}`)
+
+type configError struct {
+	file string
+	path string // dotted path of the offending key
+	line int    // zero if the position is unknown
+	col  int
+	msg  string
+}
+
+func (e *configError) Error() string {
+	var pos string
+	if e.file != "" {
+		pos = e.file + ":"
+	}
+	if e.line > 0 {
+		pos += fmt.Sprintf("%d:%d:", e.line, e.col)
+	}
+	if pos != "" {
+		pos += " "
+	}
+	if e.path == "" {
+		return pos + e.msg
+	}
+	return fmt.Sprintf("%s%s: %s", pos, e.path, e.msg)
+}
+
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i := range e {
+		msgs[i] = e[i].Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *configErrors) add(path, format string, args ...interface{}) {
+	*e = append(*e, &configError{path: path, msg: fmt.Sprintf(format, args...)})
+}
+
+type filePos struct {
+	line, col int
+}
+
+// positions maps the path of each key to its position in the source document.
+type positions map[string]filePos
+
+// lookup returns the position of path or of its nearest parent.
+func (p positions) lookup(path string) (filePos, bool) {
+	for {
+		if fp, ok := p[path]; ok {
+			return fp, true
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return filePos{}, false
+		}
+		path = path[:i]
+	}
+}
+
+// configSource is a file that defines the keys under prefix.
+type configSource struct {
+	fname  string
+	pos    positions
+	prefix string
+}
+
+func newConfigSource(fname string, pos positions, prefix string) *configSource {
+	return &configSource{fname: fname, pos: pos, prefix: prefix}
+}
+
+// rel returns path relative to the source or false if the path is not defined in it.
+func (s *configSource) rel(path string) (string, bool) {
+	if s.prefix == "" {
+		return path, true
+	}
+	if path == s.prefix {
+		return "", true
+	}
+	if strings.HasPrefix(path, s.prefix+".") {
+		return path[len(s.prefix)+1:], true
+	}
+	return "", false
+}
+
+// locate sets file, line and column of each error from the source
+// with the most specific prefix.
+func (e configErrors) locate(srcs ...*configSource) {
+	for _, ce := range e {
+		var (
+			src  *configSource
+			path string
+		)
+		for _, s := range srcs {
+			if p, ok := s.rel(ce.path); ok && (src == nil || len(s.prefix) > len(src.prefix)) {
+				src, path = s, p
+			}
+		}
+		if src == nil {
+			continue
+		}
+		ce.file = src.fname
+		ce.path = path
+		if fp, ok := src.pos.lookup(path); ok {
+			ce.line, ce.col = fp.line, fp.col
+		}
+	}
+	sort.SliceStable(e, func(i, j int) bool {
+		if e[i].file != e[j].file {
+			return e[i].file < e[j].file
+		}
+		return e[i].line < e[j].line
+	})
+}
+
+func lineCol(data []byte, off int64) (int, int) {
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	before := data[:off]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(off) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// jsonPositions returns the position of each key in a JSON document.
+// Invalid documents return the positions found until the error.
+func jsonPositions(data []byte) positions {
+	offs := make(map[string]int64)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	walkJSON(dec, data, "", offs)
+	pos := make(positions)
+	for path, off := range offs {
+		line, col := lineCol(data, off)
+		pos[path] = filePos{line, col}
+	}
+	return pos
+}
+
+// nextOffset skips separators to return the offset of the next token.
+func nextOffset(dec *json.Decoder, data []byte) int64 {
+	off := dec.InputOffset()
+	for off < int64(len(data)) && strings.IndexByte(" \t\r\n:,", data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+func walkJSON(dec *json.Decoder, data []byte, path string, pos map[string]int64) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			off := nextOffset(dec, data)
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			kpath := fmt.Sprintf("%s", key)
+			if path != "" {
+				kpath = path + "." + kpath
+			}
+			pos[kpath] = off
+			if err := walkJSON(dec, data, kpath, pos); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	case json.Delim('['):
+		for i := 0; dec.More(); i++ {
+			ipath := fmt.Sprintf("%s[%d]", path, i)
+			pos[ipath] = nextOffset(dec, data)
+			if err := walkJSON(dec, data, ipath, pos); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+// jsonError converts decoding errors to errors with a position. Type
+// errors are located by their path, as data might have been converted.
+func jsonError(fname string, data []byte, pos positions, err error) error {
+	var (
+		off int64
+		msg string
+	)
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		// Offset is after the invalid character
+		off, msg = e.Offset-1, e.Error()
+	case *json.UnmarshalTypeError:
+		errs := configErrors{&configError{path: e.Field, msg: fmt.Sprintf("cannot use %s as %s", e.Value, e.Type)}}
+		errs.locate(newConfigSource(fname, pos, ""))
+		return errs
+	default:
+		if err == io.ErrUnexpectedEOF {
+			off, msg = int64(len(data)), "unexpected end of file"
+		} else {
+			return err
+		}
+	}
+	line, col := lineCol(data, off)
+	return configErrors{&configError{file: fname, line: line, col: col, msg: msg}}
+}
+
+func checkPlaceholders(errs *configErrors, path string, tmpls []string, known []string) {
+	for i, tmpl := range tmpls {
+		for _, m := range placeholderRegexp.FindAllStringIndex(tmpl, -1) {
+			if m[0] > 0 && tmpl[m[0]-1] == '$' {
+				continue
+			}
+			ph := tmpl[m[0]:m[1]]
+			name := ph[1 : len(ph)-1]
+			found := false
+			for _, k := range known {
+				if k == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				errs.add(fmt.Sprintf("%s[%d]", path, i), "unknown placeholder %s, use one of %s", ph, strings.Join(known, ", "))
+			}
+		}
+	}
+}
+
+func (c *commandsConfig) check(errs *configErrors, path string) {
+	checkPlaceholders(errs, path+".create", c.CmdCreate, commandPlaceholders)
+	checkPlaceholders(errs, path+".update", c.CmdUpdate, commandPlaceholders)
+	checkPlaceholders(errs, path+".change", c.CmdChange, commandPlaceholders)
+	checkPlaceholders(errs, path+".destroy", c.CmdDestroy, commandPlaceholders)
+}
+
+// Invalid patterns are reported by check, do not log them while matching.
+var discardLogger = newTextLogger(ioutil.Discard, slog.LevelInfo)
+
+func (e *envConfig) check(errs *configErrors, path string) {
+	brs := branchStages(e.Branches)
+	for branch, tmpls := range e.Branches {
+		bpath := path + ".branches." + branch
+		if branch == "" {
+			errs.add(bpath, "empty branch name")
+			continue
+		}
+		if branch[0] == '^' {
+			if _, err := regexp.Compile(branch); err != nil {
+				errs.add(bpath, "invalid pattern: %s", err)
+			}
+		}
+		checkPlaceholders(errs, bpath, tmpls, stagePlaceholders)
+	}
+	for i, branch := range e.Statics {
+		if _, ok := brs.match(branch, discardLogger); ok {
+			continue
+		}
+		if _, ok := e.Branches["__default__"]; !ok {
+			errs.add(fmt.Sprintf("%s.staticBranches[%d]", path, i), "branch %s matches no stage and there is no __default__", branch)
+		}
+	}
+	for branch, dir := range e.Merges {
+		if _, err := newGitcommits().branch(dir); err != nil {
+			errs.add(path+".merges."+branch, "%s is not a git checkout", dir)
+		}
+	}
+	if e.Commands != nil {
+		e.Commands.check(errs, path+".commands")
+	}
+	checkPlaceholders(errs, path+".url", []string{e.URL}, commandPlaceholders)
+	if e.Status != nil {
+		e.Status.check(errs, path+".commit_status", e.Repository)
+	}
+	checkTokens(errs, path+".tokens", e.Tokens)
+	for i := range e.Notify {
+		e.Notify[i].check(errs, fmt.Sprintf("%s.notify[%d]", path, i))
+	}
+}
+
+// Warnings returns the settings that are valid but probably unsafe.
+func (c *config) Warnings() []string {
+	var warns []string
+	names := make([]string, 0, len(c.Envs))
+	for name := range c.Envs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		env := c.Envs[name]
+		if env.Repository == "" || env.WebhookSecret != "" {
+			continue
+		}
+		if c.authEnabled() {
+			warns = append(warns, fmt.Sprintf("environments.%s.webhook_secret: not set, webhooks for %s are refused as authentication is enabled", name, env.Repository))
+		} else {
+			warns = append(warns, fmt.Sprintf("environments.%s.webhook_secret: not set, webhook payloads for %s are not verified", name, env.Repository))
+		}
+	}
+	return warns
+}
+
+// check returns all errors found in the configuration.
+func (c *config) check() configErrors {
+	var errs configErrors
+	re, err := regexp.Compile(c.BranchRegexp)
+	if err != nil {
+		errs.add("branch_regexp", "invalid regular expression: %s", err)
+	} else if re.NumSubexp() < 1 {
+		errs.add("branch_regexp", "must have a group to capture the ticket number")
+	}
+	if c.CommandTimeout <= 0 {
+		errs.add("command_timeout", "must be a positive duration")
+	}
+	if _, ok := parseSignal(c.KillSignal); !ok {
+		errs.add("kill_signal", "unknown signal %q, use SIGTERM, SIGINT, SIGHUP or SIGQUIT", c.KillSignal)
+	}
+	if c.KillGrace < 0 {
+		errs.add("kill_grace", "must be a positive duration")
+	}
+	if c.ResultsDuration < 0 {
+		errs.add("results_duration", "must be a positive duration")
+	}
+	if c.ResultsCleanup < 0 {
+		errs.add("results_cleanup", "must be a positive duration")
+	}
+	if c.LimitBuilds < 0 {
+		errs.add("limit_builds", "must not be negative")
+	}
+	if c.QueueSize < 0 {
+		errs.add("queue_size", "must not be negative")
+	}
+	if _, ok := logLevels[c.LogLevel]; !ok {
+		errs.add("log_level", "unknown log level %s, levels are debug, info or error", c.LogLevel)
+	}
+	if _, err := newLogger(ioutil.Discard, c.LogFormat, ""); err != nil {
+		errs.add("log_format", "%s, formats are text, logfmt or json", err)
+	}
+	c.Commands.check(&errs, "commands")
+	if c.Auth != nil {
+		c.Auth.check(&errs, "auth")
+	}
+	if len(c.Envs) == 0 {
+		errs.add("environments", "no projects configured")
+	}
+	for name, env := range c.Envs {
+		env.check(&errs, "environments."+name)
+	}
+	return errs
+}
@@ -0,0 +1,76 @@
+// Copyright 2016 Giulio Iotti. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package umarell
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const invalidConfig = `{
+	"branch_regexp": "^[A-Z]+-\\d+",
+	"command_timeout": "10m",
+	"log_format": "xml",
+	"log_level": "verbose",
+	"commands": {
+		"create": ["deploy-tool", "env:init", "{STAGE}", "-b", "{BRANCHNAME}"]
+	},
+	"environments": {
+		"projectNemo": {
+			"branches": {
+				"master": ["{ENV}.dev"],
+				"^release/(": ["{ENV}.uat"]
+			},
+			"staticBranches": ["master", "production"]
+		}
+	}
+}`
+
+func TestConfigCheck(t *testing.T) {
+	var c config
+	if err := json.Unmarshal([]byte(invalidConfig), &c); err != nil {
+		t.Fatal(err)
+	}
+	errs := c.check()
+	errs.locate(newConfigSource("config.json", jsonPositions([]byte(invalidConfig)), ""))
+	expected := []string{
+		"config.json:2:2: branch_regexp: must have a group to capture the ticket number",
+		"config.json:4:2: log_format: unknown log format xml",
+		"config.json:5:2: log_level: unknown log level verbose",
+		"config.json:7:58: commands.create[4]: unknown placeholder {BRANCHNAME}, use one of ENV, TICKET, BRANCH, STAGE",
+		"config.json:13:5: environments.projectNemo.branches.^release/(: invalid pattern",
+		"config.json:15:33: environments.projectNemo.staticBranches[1]: branch production matches no stage and there is no __default__",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got:\n%s", len(expected), errs)
+	}
+	for i := range expected {
+		if !strings.HasPrefix(errs[i].Error(), expected[i]) {
+			t.Errorf("expected error %q, got %q", expected[i], errs[i])
+		}
+	}
+}
+
+func TestConfigSyntaxError(t *testing.T) {
+	data := []byte("{\n\t\"table\": \"results\"\n\t\"limit_builds\": 2\n}")
+	var c config
+	err := jsonError("config.json", data, nil, json.Unmarshal(data, &c))
+	if !strings.HasPrefix(err.Error(), "config.json:3:2: ") {
+		t.Errorf("unexpected error position: %s", err)
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	c := &config{Envs: map[string]envConfig{
+		"projectNemo":   {Repository: "https://github.com/acme/nemo.git"},
+		"projectDory":   {Repository: "https://github.com/acme/dory.git", WebhookSecret: "s3cr3t"},
+		"projectMarlin": {},
+	}}
+	warns := c.Warnings()
+	if len(warns) != 1 || !strings.HasPrefix(warns[0], "environments.projectNemo.webhook_secret: not set") {
+		t.Errorf("unexpected warnings %q", warns)
+	}
+}